@@ -1,6 +1,8 @@
 package lib
 
 import (
+	"bytes"
+	"errors"
 	"log"
 	"os"
 	"os/exec"
@@ -9,8 +11,7 @@ import (
 	"syscall"
 	"sync"
 	"strconv"
-	"io/ioutil"
-	"regexp"
+	"runtime"
 	"time"
 
 	"github.com/spf13/viper"
@@ -21,18 +22,41 @@ import (
 
 type FileEntry struct {
 	Checksum string
+	BaseChecksum string `json:",omitempty"`
 	Modification int64
+	Size	 int64
+	Mode	 os.FileMode
+	Symlink	 string `json:",omitempty"`
 	Content	 []byte
+	Deleted	 bool
+	inode	 uint64
 }
 
 type Status struct {
 	Health	 string
+	Errors	 map[string]string `json:",omitempty"`
+	Revision int `json:",omitempty"`
+	Conflicts map[string]string `json:",omitempty"`
+	Quota	 *QuotaError `json:",omitempty"`
+	Hooks	 []HookResult `json:",omitempty"`
+	Restart	 string `json:",omitempty"`
+	RestartID int `json:",omitempty"`
+	PendingRestart int `json:",omitempty"`
+	DryRun	 *DryRun `json:",omitempty"`
 }
 
+const (
+	RESTART_FULL = "restart"
+	RESTART_RELOAD = "reload"
+	RESTART_PENDING = "pending"
+)
+
 var task *runner.Task
 var cmd *exec.Cmd
 var lock = sync.RWMutex{}
+var storeLock = sync.RWMutex{}
 var cmdRaw = ""
+var lastRestart = ""
 var store = map[string]*FileEntry{}
 
 func RestartApp(backendRunCommand string) Status {
@@ -74,38 +98,188 @@ func RestartApp(backendRunCommand string) Status {
 		return nil
 	})
 	lock.RUnlock()
-	return Status{Health: "Restarting"}
+	setLastRestart(RESTART_FULL)
+	return Status{Health: "Restarting", Restart: RESTART_FULL}
+}
+
+// ReloadApp sends the reload_signal to the running backend so it reloads its
+// code in place. Without a reload_signal, or if the backend cannot be
+// signalled, the backend is restarted instead. It returns RESTART_RELOAD or
+// RESTART_FULL.
+func ReloadApp() string {
+	name := viper.GetString(CONFIG_RELOAD_SIGNAL)
+	if len(name) == 0 {
+		RestartApp("")
+		return RESTART_FULL
+	}
+	_, signal, err := parseSignal(name)
+	if err == nil {
+		err = SignalApp(signal)
+	}
+	if err != nil {
+		log.Println("Unable to reload backend, restarting: " + err.Error())
+		RestartApp("")
+		return RESTART_FULL
+	}
+	setLastRestart(RESTART_RELOAD)
+	return RESTART_RELOAD
+}
+
+func setLastRestart(kind string) {
+	lock.Lock()
+	lastRestart = kind
+	lock.Unlock()
 }
 
+// ValidateReloadSignal reports an unsupported reload_signal.
+func ValidateReloadSignal() error {
+	name := viper.GetString(CONFIG_RELOAD_SIGNAL)
+	if len(name) == 0 {
+		return nil
+	}
+	_, _, err := parseSignal(name)
+	return err
+}
+
+// SignalApp sends sig to the running backend.
+func SignalApp(sig os.Signal) error {
+	lock.RLock()
+	defer lock.RUnlock()
+	if cmd == nil || cmd.Process == nil {
+		return errors.New("backend is not running")
+	}
+	log.Println("Sending " + sig.String() + " to backend")
+	return cmd.Process.Signal(sig)
+}
+
+// ListFiles returns the index of all files in the backend dirs, keyed by their
+// client paths. While the watcher keeps the index current it is served from
+// memory, otherwise the dirs are walked again.
 func ListFiles() map[string]*FileEntry {
-	for _, dir := range GetAppDirs() {
+	if !IsWatching() {
+		reindex(GetRootDirs())
+	}
+	roots := GetRoots()
+	storeLock.RLock()
+	defer storeLock.RUnlock()
+	files := make(map[string]*FileEntry, len(store))
+	for path, fileEntry := range store {
+		files[clientPath(roots, path)] = fileEntry
+	}
+	return files
+}
+
+// reindex walks all dirs and drops store entries of files that are gone.
+func reindex(dirs []string) {
+	LoadIgnoreRules()
+	seen := map[string]bool{}
+	for _, dir := range dirs {
 		log.Println("Listing files for: " + dir)
-		err := filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
-			if f.IsDir() {
-				return nil
-			}
-			if store[path] != nil && store[path].Modification == f.ModTime().Unix() {
-				// cache hit
-				return nil
-			}
-			if strings.HasPrefix(path, ".git") {
-				// ignore .git
-				return nil
+		indexDir(dir, seen)
+	}
+	storeLock.Lock()
+	for path := range store {
+		if !seen[path] {
+			delete(store, path)
+		}
+	}
+	storeLock.Unlock()
+	scheduleCacheSave()
+}
+
+// indexDir indexes all files below dir and records their paths in seen,
+// unless it is nil. Files are hashed by a bounded pool of workers.
+func indexDir(dir string, seen map[string]bool) {
+	type job struct {
+		path string
+		info os.FileInfo
+	}
+	jobs := make(chan job)
+	workers := sync.WaitGroup{}
+	for i := 0; i < hashWorkers(); i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for j := range jobs {
+				indexFile(j.path, j.info, false)
 			}
-			fileEntry := FileEntry{}
-			checksum, _ := utils.ChecksumsForFile(path)
-			fileEntry.Checksum = checksum.SHA256
-			fileEntry.Modification = f.ModTime().Unix()
-			lock.RLock()
-			store[path] = &fileEntry
-			lock.RUnlock()
-			return nil
-		})
+		}()
+	}
+	err := filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
 		if err != nil {
 			log.Println(err)
+			return nil
+		}
+		if f.IsDir() {
+			if path != dir && IsIgnored(path, true) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if IsIgnored(path, false) {
+			return nil
 		}
+		if seen != nil {
+			seen[path] = true
+		}
+		jobs <- job{path, f}
+		return nil
+	})
+	close(jobs)
+	workers.Wait()
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func hashWorkers() int {
+	workers := viper.GetInt(CONFIG_HASH_WORKERS)
+	if workers <= 0 {
+		return runtime.NumCPU()
+	}
+	return workers
+}
+
+// indexFile updates the store entry of path. Unless force is set, files whose
+// modification time and mode did not change are not hashed again.
+func indexFile(path string, f os.FileInfo, force bool) {
+	if IsIgnored(path, false) {
+		return
+	}
+	storeLock.RLock()
+	cached := store[path]
+	storeLock.RUnlock()
+	algorithm := ChecksumAlgorithm()
+	if !force && cached != nil && cached.Modification == f.ModTime().Unix() && cached.Mode == f.Mode().Perm() &&
+		cached.Size == f.Size() && cached.inode == fileInode(f) &&
+		(len(cached.Symlink) > 0 || checksumAlgorithmOf(cached.Checksum) == algorithm) {
+		// cache hit
+		return
+	}
+	fileEntry := FileEntry{Size: f.Size(), inode: fileInode(f)}
+	if f.Mode()&os.ModeSymlink != 0 {
+		// describe symlinks instead of following them
+		fileEntry.Symlink, _ = os.Readlink(path)
+	} else {
+		checksum, _ := utils.ChecksumsForFile(path, algorithm)
+		fileEntry.Checksum = FormatChecksum(algorithm, checksum)
+	}
+	fileEntry.Modification = f.ModTime().Unix()
+	fileEntry.Mode = f.Mode().Perm()
+	storeLock.Lock()
+	store[path] = &fileEntry
+	storeLock.Unlock()
+	scheduleCacheSave()
+}
+
+func (s *Status) AddError(path string, err error) {
+	if s.Errors == nil {
+		s.Errors = map[string]string{}
+	}
+	s.Errors[path] = err.Error()
+	if quota, ok := err.(*QuotaError); ok && s.Quota == nil {
+		s.Quota = quota
 	}
-	return store
 }
 
 func GetStatus() Status {
@@ -116,62 +290,132 @@ func GetStatus() Status {
 	} else {
 		status.Health = "Not-Running"
 	}
+	lock.RLock()
+	status.Restart = lastRestart
+	lock.RUnlock()
+	status.RestartID, status.PendingRestart = restartState()
 	return status
 }
 
-func UploadFiles(files map[string]*FileEntry) Status {
+// UploadFiles writes, links or deletes the files as a single batch. With
+// dryRun the files are only validated.
+func UploadFiles(files map[string]*FileEntry, dryRun bool) Status {
 	status := Status{}
-	failed := 0
 	updated := 0
-	restart := false
+	deleted := 0
+	tx := newTransaction()
+	tx.dryRun = dryRun
 	for path, fileEntry := range files {
-		log.Println("Updating file: " + path)
-		dir := filepath.Dir(path)
-		os.MkdirAll(dir, 0755)
-		err := ioutil.WriteFile(path, fileEntry.Content, 0644)
-		if err != nil {
-			log.Println(err)
-			failed++
+		var err error
+		if fileEntry.Deleted {
+			log.Println("Deleting file: " + path)
+			err = tx.Delete(path)
+			deleted++
+		} else if len(fileEntry.Symlink) > 0 {
+			log.Println("Updating symlink: " + path)
+			err = tx.Symlink(path, fileEntry.Symlink)
+			updated++
+		} else if len(fileEntry.Content) == 0 && HasBlob(fileEntry.Checksum) {
+			// content was uploaded to the blob store before
+			log.Println("Updating file from blob: " + path)
+			err = writeBlob(tx, path, fileEntry)
+			updated++
 		} else {
-			if NeedsRestart(path) {
-				restart = true
-			}
+			log.Println("Updating file: " + path)
+			// check the quotas with the actual size, Size is optional
+			entry := *fileEntry
+			entry.Size = int64(len(fileEntry.Content))
+			err = tx.Write(path, bytes.NewReader(fileEntry.Content), &entry)
 			updated++
 		}
+		if err == nil {
+			err = tx.Expect(path, fileEntry.BaseChecksum)
+		}
+		if err != nil {
+			log.Println(path + ": " + err.Error())
+			status.AddError(path, err)
+		}
 	}
+	return commitFiles(tx, status, updated, deleted)
+}
 
-	if failed > 0 {
-		status.Health = "Failed to update " + strconv.Itoa(failed) + " files"
-	} else {
-		status.Health = "Updated " + strconv.Itoa(updated) + " files without restart"
+// commitFiles commits a staged batch unless staging reported errors. Once the
+// batch is in place it runs the triggered hooks and, if all of them succeeded,
+// restarts or signals the backend as the rules require. A dry run only
+// reports what would happen.
+func commitFiles(tx *transaction, status Status, updated int, deleted int) Status {
+	if len(status.Errors) > 0 {
+		tx.Abort()
+		status.Health = "Failed to update " + strconv.Itoa(len(status.Errors)) + " files, no files were changed"
+		return status
+	}
+	if err := tx.Commit(); err != nil {
+		if conflict, ok := err.(*ConflictError); ok {
+			status.Conflicts = conflict.Conflicts
+			status.Health = "Conflicting changes of " + strconv.Itoa(len(conflict.Conflicts)) + " files, no files were changed"
+			return status
+		}
+		if quota, ok := err.(*QuotaError); ok {
+			status.Quota = quota
+		}
+		status.Health = "Failed to commit update, no files were changed: " + err.Error()
+		return status
+	}
+	if tx.dryRun {
+		status.DryRun = tx.dryRunReport()
+		status.Health = "Dry run, would update " + strconv.Itoa(updated) + " files" + deletedSuffix("delete", deleted)
+		return status
 	}
+	status.Revision = tx.revision
+	// deleting a missing file is not a change
+	deleted -= tx.missingDeletes()
 
-	if restart {
-		RestartApp("")
-		status.Health = "Restarting after updating " + strconv.Itoa(updated) + " files"
+	status.Health = "Updated " + strconv.Itoa(updated) + " files" + deletedSuffix("deleted", deleted) + " without restart"
+	status.Hooks = runHooks(tx.ops)
+	if failed := failedHook(status.Hooks); len(failed) > 0 {
+		status.Health = "Updated " + strconv.Itoa(updated) + " files" + deletedSuffix("deleted", deleted) + ", not restarting as hook " + failed + " failed"
+		return status
+	}
+	plan := planChanges(tx.clientPaths())
+	if plan.restart {
+		status.RestartID, status.Restart = RequestRestart()
+		switch status.Restart {
+		case RESTART_PENDING:
+			status.Health = "Restart " + strconv.Itoa(status.RestartID) + " scheduled after updating " + strconv.Itoa(updated) + " files" + deletedSuffix("deleting", deleted)
+		case RESTART_RELOAD:
+			status.Health = "Reloading after updating " + strconv.Itoa(updated) + " files" + deletedSuffix("deleting", deleted)
+		default:
+			status.Health = "Restarting after updating " + strconv.Itoa(updated) + " files" + deletedSuffix("deleting", deleted)
+		}
+		return status
+	}
+	for _, rule := range plan.signals {
+		signal := strings.TrimPrefix(rule.Action, actionSignal)
+		if err := SignalApp(rule.signal); err != nil {
+			log.Println("Unable to send " + signal + ": " + err.Error())
+			status.Health = "Updated " + strconv.Itoa(updated) + " files" + deletedSuffix("deleted", deleted) + ", failed to send " + signal + ": " + err.Error()
+			return status
+		}
+		status.Health = "Sent " + signal + " after updating " + strconv.Itoa(updated) + " files" + deletedSuffix("deleting", deleted)
+		status.Restart = RESTART_RELOAD
+		setLastRestart(RESTART_RELOAD)
 	}
 	return status
 }
 
-
-func NeedsRestart(path string) bool {
-	ignoreRegex := viper.GetString(CONFIG_IGNORE_REGEX)
-	if len(ignoreRegex) > 0 {
-		match, _ := regexp.MatchString(ignoreRegex, path)
-		if match {
-			log.Println("Skipping restart for: " + path)
-			return false
-		}
+func DeleteFiles(paths []string) Status {
+	files := map[string]*FileEntry{}
+	for _, path := range paths {
+		files[path] = &FileEntry{Deleted: true}
 	}
-	restartRegex := viper.GetString(CONFIG_RESTART_REGEX)
-	if len(restartRegex) > 0 {
-		match, _ := regexp.MatchString(restartRegex, path)
-		if match {
-			log.Println("Requires restart for: " + path)
-			return true
-		}
+	return UploadFiles(files, false)
+}
+
+func deletedSuffix(verb string, deleted int) string {
+	if deleted == 0 {
+		return ""
 	}
-	return false
+	return " and " + verb + " " + strconv.Itoa(deleted) + " files"
 }
 
 func GetAppDirs() []string {
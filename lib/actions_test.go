@@ -0,0 +1,77 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/xiwenc/cf-fastpush-controller/utils"
+)
+
+// generateTree configures a new backend dir holding dirs directories of files
+// files of size bytes each.
+func generateTree(b *testing.B, dirs int, files int, size int) string {
+	root := b.TempDir()
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	for d := 0; d < dirs; d++ {
+		dir := filepath.Join(root, "dir"+strconv.Itoa(d))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			b.Fatal(err)
+		}
+		for f := 0; f < files; f++ {
+			path := filepath.Join(dir, "file"+strconv.Itoa(f))
+			if err := ioutil.WriteFile(path, content, 0644); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	viper.Set(CONFIG_BACKEND_DIRS, root)
+	LoadIgnoreRules()
+	return root
+}
+
+func BenchmarkIndexDir(b *testing.B) {
+	root := generateTree(b, 50, 40, 16*1024)
+	defer viper.Set(CONFIG_HASH_WORKERS, 0)
+	for _, workers := range []int{1, 0} {
+		name := "pooled"
+		if workers == 1 {
+			name = "serial"
+		}
+		b.Run(name, func(b *testing.B) {
+			viper.Set(CONFIG_HASH_WORKERS, workers)
+			b.SetBytes(50 * 40 * 16 * 1024)
+			for i := 0; i < b.N; i++ {
+				storeLock.Lock()
+				store = map[string]*FileEntry{}
+				storeLock.Unlock()
+				indexDir(root, nil)
+			}
+		})
+	}
+}
+
+func BenchmarkChecksum(b *testing.B) {
+	content := make([]byte, 1024*1024)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	for _, algorithm := range []string{utils.SHA256, utils.CRC32C} {
+		b.Run(algorithm, func(b *testing.B) {
+			b.SetBytes(int64(len(content)))
+			for i := 0; i < b.N; i++ {
+				sum := utils.NewChecksumWriter(algorithm)
+				sum.Write(content)
+				if len(sum.Sum().Get(algorithm)) == 0 {
+					b.Fatalf("no %s checksum", algorithm)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/spf13/viper"
+	"github.com/xiwenc/cf-fastpush-controller/utils"
+)
+
+var blobNamePattern = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// BlobPath returns the location of the blob with the given SHA256.
+func BlobPath(sum string) (string, error) {
+	if !blobNamePattern.MatchString(sum) {
+		return "", errors.New("invalid SHA256: " + sum)
+	}
+	return filepath.Join(viper.GetString(CONFIG_BLOB_DIR), sum), nil
+}
+
+// StoreBlob saves the content read from r under its SHA256, which must match
+// sum. Storing an existing blob is a no-op. Blobs are subject to
+// max_file_size and min_free_space like files.
+func StoreBlob(sum string, r io.Reader) error {
+	path, err := BlobPath(sum)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err == nil {
+		io.Copy(ioutil.Discard, r)
+		return nil
+	}
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := checkFileQuota(dir, 0); err != nil {
+		return err
+	}
+	temp, err := ioutil.TempFile(dir, stagingPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	checksum := utils.NewChecksumWriter(utils.SHA256)
+	_, err = io.Copy(temp, io.TeeReader(limitFile(r), checksum))
+	if cerr := temp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if actual := checksum.Sum().SHA256; actual != sum {
+		return fmt.Errorf("checksum mismatch: expected %s, got %s", sum, actual)
+	}
+	log.Println("Stored blob: " + sum)
+	return os.Rename(temp.Name(), path)
+}
+
+// HasBlob reports whether the blob with the given SHA256 is stored.
+func HasBlob(sum string) bool {
+	path, err := BlobPath(sum)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+// MissingBlobs returns the subset of sums that still have to be uploaded.
+func MissingBlobs(sums []string) []string {
+	missing := []string{}
+	for _, sum := range sums {
+		if !HasBlob(sum) {
+			missing = append(missing, sum)
+		}
+	}
+	return missing
+}
+
+// CommitManifest materializes stored blobs into the backend dirs. The manifest
+// maps file paths to the SHA256 of their content.
+func CommitManifest(manifest map[string]string) Status {
+	status := Status{}
+	updated := 0
+	tx := newTransaction()
+	for path, sum := range manifest {
+		log.Println("Updating file: " + path)
+		if err := writeBlob(tx, path, &FileEntry{Checksum: sum}); err != nil {
+			log.Println(path + ": " + err.Error())
+			status.AddError(path, err)
+			continue
+		}
+		updated++
+	}
+	return commitFiles(tx, status, updated, 0)
+}
+
+// writeBlob stages the blob named by the Checksum of entry for path.
+func writeBlob(tx *transaction, path string, entry *FileEntry) error {
+	sum := entry.Checksum
+	blob, err := BlobPath(sum)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(blob)
+	if os.IsNotExist(err) {
+		return errors.New("missing blob " + sum)
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	sized := *entry
+	sized.Size = info.Size()
+	return tx.Write(path, file, &sized)
+}
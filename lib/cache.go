@@ -0,0 +1,124 @@
+package lib
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// cacheSaveDelay coalesces store updates into one write of the cache file.
+const cacheSaveDelay = 5 * time.Second
+
+// cacheEntry is the persisted form of a store entry. Besides the checksum it
+// keeps the stat data used to decide whether a file has to be hashed again.
+type cacheEntry struct {
+	Checksum     string
+	Symlink      string `json:",omitempty"`
+	Size         int64
+	Modification int64
+	Mode         os.FileMode
+	Inode        uint64
+}
+
+var cacheLock = sync.Mutex{}
+var cacheSave *time.Timer
+
+// LoadCache fills the store from the cache file. Entries are only trusted as
+// long as their stat data matches the file on disk.
+func LoadCache() {
+	path := viper.GetString(CONFIG_CACHE_FILE)
+	if len(path) == 0 {
+		return
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Unable to read cache: " + err.Error())
+		}
+		return
+	}
+	entries := map[string]cacheEntry{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		log.Println("Ignoring invalid cache: " + err.Error())
+		return
+	}
+	storeLock.Lock()
+	for file, entry := range entries {
+		store[file] = &FileEntry{
+			Checksum:     entry.Checksum,
+			Symlink:      entry.Symlink,
+			Size:         entry.Size,
+			Modification: entry.Modification,
+			Mode:         entry.Mode,
+			inode:        entry.Inode,
+		}
+	}
+	storeLock.Unlock()
+	log.Printf("Loaded %d cached checksums from %s", len(entries), path)
+}
+
+// SaveCache writes the store to the cache file.
+func SaveCache() error {
+	path := viper.GetString(CONFIG_CACHE_FILE)
+	if len(path) == 0 {
+		return nil
+	}
+	storeLock.RLock()
+	entries := make(map[string]cacheEntry, len(store))
+	for file, fileEntry := range store {
+		entries[file] = cacheEntry{
+			Checksum:     fileEntry.Checksum,
+			Symlink:      fileEntry.Symlink,
+			Size:         fileEntry.Size,
+			Modification: fileEntry.Modification,
+			Mode:         fileEntry.Mode,
+			Inode:        fileEntry.inode,
+		}
+	}
+	storeLock.RUnlock()
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	temp, err := ioutil.TempFile(filepath.Dir(path), stagingPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	_, err = temp.Write(data)
+	if cerr := temp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
+
+func scheduleCacheSave() {
+	if len(viper.GetString(CONFIG_CACHE_FILE)) == 0 {
+		return
+	}
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+	if cacheSave != nil {
+		return
+	}
+	cacheSave = time.AfterFunc(cacheSaveDelay, func() {
+		cacheLock.Lock()
+		cacheSave = nil
+		cacheLock.Unlock()
+		if err := SaveCache(); err != nil {
+			log.Println("Unable to save cache: " + err.Error())
+		}
+	})
+}
@@ -0,0 +1,50 @@
+package lib
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/spf13/viper"
+	"github.com/xiwenc/cf-fastpush-controller/utils"
+)
+
+// ErrChecksumAlgorithm rejects an uploaded checksum of another algorithm than
+// SHA256. Other algorithms are only used to compare indexes.
+var ErrChecksumAlgorithm = errors.New("uploads have to be verified with a SHA256 checksum")
+
+// ChecksumAlgorithm returns the configured algorithm for indexing files. An
+// unknown algorithm falls back to SHA256, see ValidateChecksumAlgorithm.
+func ChecksumAlgorithm() string {
+	algorithm := strings.ToLower(viper.GetString(CONFIG_CHECKSUM_ALGORITHM))
+	if !utils.IsChecksumAlgorithm(algorithm) {
+		return utils.SHA256
+	}
+	return algorithm
+}
+
+// ValidateChecksumAlgorithm reports an unknown configured algorithm.
+func ValidateChecksumAlgorithm() error {
+	algorithm := viper.GetString(CONFIG_CHECKSUM_ALGORITHM)
+	if len(algorithm) > 0 && !utils.IsChecksumAlgorithm(strings.ToLower(algorithm)) {
+		return errors.New("unknown checksum algorithm: " + algorithm)
+	}
+	return nil
+}
+
+// FormatChecksum returns the checksum of algorithm as stored in a FileEntry.
+// SHA256 checksums are plain hex strings, others are prefixed with the name of
+// their algorithm, e.g. "crc32c:1c291ca3".
+func FormatChecksum(algorithm string, sum utils.ChecksumInfo) string {
+	if algorithm == utils.SHA256 {
+		return sum.SHA256
+	}
+	return algorithm + ":" + sum.Get(algorithm)
+}
+
+// checksumAlgorithmOf returns the algorithm of a checksum in FileEntry format.
+func checksumAlgorithmOf(checksum string) string {
+	if i := strings.Index(checksum, ":"); i > 0 && utils.IsChecksumAlgorithm(checksum[:i]) {
+		return checksum[:i]
+	}
+	return utils.SHA256
+}
@@ -0,0 +1,77 @@
+package lib
+
+import (
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/xiwenc/cf-fastpush-controller/utils"
+)
+
+// AbsentChecksum is the base checksum of a file that must not exist yet.
+const AbsentChecksum = "-"
+
+// ConflictError lists the files that changed since the client listed them,
+// mapping their client paths to their current checksums.
+type ConflictError struct {
+	Conflicts map[string]string
+}
+
+func (e *ConflictError) Error() string {
+	paths := []string{}
+	for path := range e.Conflicts {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return "conflicting changes of " + strings.Join(paths, ", ")
+}
+
+// Expect records the checksum the client expects path to have before the
+// transaction is applied. An empty base disables the check.
+func (t *transaction) Expect(path string, base string) error {
+	if len(base) == 0 {
+		return nil
+	}
+	resolved, err := ResolveParentPath(path)
+	if err != nil {
+		return err
+	}
+	if t.expected == nil {
+		t.expected = map[string]string{}
+	}
+	t.expected[resolved] = base
+	return nil
+}
+
+// checkConflicts compares the expected with the current checksums. It must be
+// called while holding commitLock.
+func (t *transaction) checkConflicts() error {
+	conflicts := map[string]string{}
+	for path, base := range t.expected {
+		current := currentChecksum(path, checksumAlgorithmOf(base))
+		if current != base {
+			conflicts[ClientPath(path)] = current
+		}
+	}
+	if len(conflicts) > 0 {
+		return &ConflictError{Conflicts: conflicts}
+	}
+	return nil
+}
+
+// currentChecksum returns the checksum of the file at path on disk, or
+// AbsentChecksum if there is none.
+func currentChecksum(path string, algorithm string) string {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return AbsentChecksum
+	}
+	if err != nil || info.Mode()&os.ModeSymlink != 0 {
+		return ""
+	}
+	sum, err := utils.ChecksumsForFile(path, algorithm)
+	if err != nil {
+		return ""
+	}
+	return FormatChecksum(algorithm, sum)
+}
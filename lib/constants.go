@@ -9,4 +9,32 @@ const (
 	CONFIG_RESTART_REGEX = "restart_regex"
 	CONFIG_IGNORE_REGEX = "ignore_regex"
 	CONFIG_BASE_PATH = "base_path"
+	CONFIG_DELTA_BLOCK_SIZE = "delta_block_size"
+	CONFIG_BLOB_DIR = "blob_dir"
+	CONFIG_WATCH_FILES = "watch_files"
+	CONFIG_CACHE_FILE = "cache_file"
+	CONFIG_CHECKSUM_ALGORITHM = "checksum_algorithm"
+	CONFIG_HASH_WORKERS = "hash_workers"
+	CONFIG_IGNORE_FILES = "ignore_files"
+	CONFIG_IGNORE_PATTERNS = "ignore_patterns"
+	CONFIG_REVISION_DIR = "revision_dir"
+	CONFIG_REVISION_LIMIT = "revision_limit"
+	CONFIG_UPLOAD_DIR = "upload_dir"
+	CONFIG_MAX_REQUEST_SIZE = "max_request_size"
+	CONFIG_MAX_FILE_SIZE = "max_file_size"
+	CONFIG_MAX_BATCH_FILES = "max_batch_files"
+	CONFIG_MAX_TOTAL_SIZE = "max_total_size"
+	CONFIG_MIN_FREE_SPACE = "min_free_space"
+	CONFIG_HOOKS = "hooks"
+	CONFIG_RULES = "rules"
+	CONFIG_RELOAD_SIGNAL = "reload_signal"
+	CONFIG_RESTART_QUIET_PERIOD = "restart_quiet_period"
+)
+
+const (
+	PAX_CHECKSUM = "FASTPUSH.checksum"
+	PAX_BASE_CHECKSUM = "FASTPUSH.base_checksum"
+	HEADER_CHECKSUM = "X-Fastpush-Checksum"
+	HEADER_BASE_CHECKSUM = "X-Fastpush-Base-Checksum"
+	HEADER_NEXT_CURSOR = "X-Fastpush-Next-Cursor"
 )
@@ -0,0 +1,159 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/spf13/viper"
+	"github.com/xiwenc/cf-fastpush-controller/utils"
+)
+
+type BlockSignature struct {
+	Weak   uint32
+	Strong string
+}
+
+type FileSignature struct {
+	BlockSize int
+	Size      int64
+	Checksum  string
+	Blocks    []BlockSignature
+}
+
+// DeltaOp either copies Count blocks starting at Block from the current file
+// or inserts the literal Data.
+type DeltaOp struct {
+	Block int    `json:",omitempty"`
+	Count int    `json:",omitempty"`
+	Data  []byte `json:",omitempty"`
+}
+
+type FileDelta struct {
+	BlockSize    int
+	Checksum     string
+	BaseChecksum string `json:",omitempty"`
+	Ops          []DeltaOp
+}
+
+// GetSignature returns the block signatures of path. A blockSize of 0 uses the
+// configured default.
+func GetSignature(path string, blockSize int) (FileSignature, error) {
+	if blockSize <= 0 {
+		blockSize = viper.GetInt(CONFIG_DELTA_BLOCK_SIZE)
+	}
+	if blockSize <= 0 {
+		return FileSignature{}, errors.New("invalid block size")
+	}
+	resolved, err := ResolvePath(path)
+	if err != nil {
+		return FileSignature{}, err
+	}
+	file, err := os.Open(resolved)
+	if err != nil {
+		return FileSignature{}, err
+	}
+	defer file.Close()
+
+	signature := FileSignature{BlockSize: blockSize}
+	whole := utils.NewChecksumWriter(utils.SHA256)
+	block := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(file, block)
+		if n > 0 {
+			whole.Write(block[:n])
+			strong := utils.NewChecksumWriter(utils.SHA256)
+			strong.Write(block[:n])
+			signature.Blocks = append(signature.Blocks, BlockSignature{
+				Weak:   utils.WeakChecksum(block[:n]),
+				Strong: strong.Sum().SHA256,
+			})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return FileSignature{}, err
+		}
+	}
+	sum := whole.Sum()
+	signature.Size = sum.Size
+	signature.Checksum = sum.SHA256
+	return signature, nil
+}
+
+// ApplyDeltas rebuilds each file from its current content and the given delta
+// and commits the batch only if every result matches its declared SHA256.
+func ApplyDeltas(deltas map[string]*FileDelta) Status {
+	status := Status{}
+	updated := 0
+	tx := newTransaction()
+	for path, delta := range deltas {
+		log.Println("Patching file: " + path)
+		if err := applyDelta(tx, path, delta); err != nil {
+			log.Println(path + ": " + err.Error())
+			status.AddError(path, err)
+			continue
+		}
+		updated++
+	}
+	return commitFiles(tx, status, updated, 0)
+}
+
+func applyDelta(tx *transaction, path string, delta *FileDelta) error {
+	if delta.BlockSize <= 0 {
+		return errors.New("invalid block size")
+	}
+	if len(delta.Checksum) == 0 {
+		return errors.New("missing checksum")
+	}
+	resolved, err := ResolvePath(path)
+	if err != nil {
+		return err
+	}
+	var mode os.FileMode
+	if info, err := os.Stat(resolved); err == nil {
+		// keep the mode of the file being patched
+		mode = info.Mode().Perm()
+	}
+	var base *os.File
+	var baseSize int64
+	for _, op := range delta.Ops {
+		if op.Count > 0 && base == nil {
+			base, err = os.Open(resolved)
+			if err != nil {
+				return err
+			}
+			defer base.Close()
+			info, err := base.Stat()
+			if err != nil {
+				return err
+			}
+			baseSize = info.Size()
+		}
+	}
+
+	readers := []io.Reader{}
+	blockSize := int64(delta.BlockSize)
+	for _, op := range delta.Ops {
+		if op.Count > 0 {
+			offset := int64(op.Block) * blockSize
+			if op.Block < 0 || offset >= baseSize {
+				return fmt.Errorf("block %d out of range", op.Block)
+			}
+			readers = append(readers, io.NewSectionReader(base, offset, int64(op.Count)*blockSize))
+		}
+		if len(op.Data) > 0 {
+			readers = append(readers, bytes.NewReader(op.Data))
+		}
+	}
+
+	err = tx.Write(path, io.MultiReader(readers...), &FileEntry{Checksum: delta.Checksum, Mode: mode})
+	if err != nil {
+		return err
+	}
+	return tx.Expect(path, delta.BaseChecksum)
+}
@@ -0,0 +1,70 @@
+package lib
+
+import (
+	"sort"
+
+	"github.com/xiwenc/cf-fastpush-controller/utils"
+)
+
+// Diff compares a client manifest with the file index.
+type Diff struct {
+	// Missing paths exist in the manifest only
+	Missing []string
+	// Changed paths have a different checksum
+	Changed []string
+	// Extra paths exist in the backend dirs only
+	Extra []string
+	// Restart reports whether applying the diff restarts the backend
+	Restart bool
+}
+
+// DiffFiles compares the manifest, mapping client paths to checksums, with the
+// file index. Checksums of another algorithm than the index are calculated on
+// demand.
+func DiffFiles(manifest map[string]string) Diff {
+	diff := Diff{Missing: []string{}, Changed: []string{}, Extra: []string{}}
+	files := ListFiles()
+	for path, checksum := range manifest {
+		fileEntry, found := files[path]
+		if !found {
+			diff.Missing = append(diff.Missing, path)
+		} else if remoteChecksum(path, fileEntry, checksum) != checksum {
+			diff.Changed = append(diff.Changed, path)
+		} else {
+			continue
+		}
+		if NeedsRestart(path) {
+			diff.Restart = true
+		}
+	}
+	for path := range files {
+		if _, found := manifest[path]; !found {
+			diff.Extra = append(diff.Extra, path)
+			if NeedsRestart(path) {
+				diff.Restart = true
+			}
+		}
+	}
+	sort.Strings(diff.Missing)
+	sort.Strings(diff.Changed)
+	sort.Strings(diff.Extra)
+	return diff
+}
+
+// remoteChecksum returns the checksum of an indexed file in the algorithm of
+// the client's checksum.
+func remoteChecksum(path string, fileEntry *FileEntry, checksum string) string {
+	algorithm := checksumAlgorithmOf(checksum)
+	if len(fileEntry.Symlink) > 0 || checksumAlgorithmOf(fileEntry.Checksum) == algorithm {
+		return fileEntry.Checksum
+	}
+	resolved, err := ResolveParentPath(path)
+	if err != nil {
+		return ""
+	}
+	sum, err := utils.ChecksumsForFile(resolved, algorithm)
+	if err != nil {
+		return ""
+	}
+	return FormatChecksum(algorithm, sum)
+}
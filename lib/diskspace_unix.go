@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package lib
+
+import (
+	"syscall"
+)
+
+// freeSpace returns the bytes available to the controller on the filesystem
+// of dir.
+func freeSpace(dir string) (int64, error) {
+	stat := syscall.Statfs_t{}
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return -1, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,6 @@
+package lib
+
+// freeSpace returns -1 as the free space is not determined on windows.
+func freeSpace(dir string) (int64, error) {
+	return -1, nil
+}
@@ -0,0 +1,43 @@
+package lib
+
+import (
+	"errors"
+	"os"
+
+	"github.com/xiwenc/cf-fastpush-controller/utils"
+)
+
+// OpenFile opens the file at the client path for reading and returns its stat
+// data and SHA256. The indexed checksum is used while it is current.
+func OpenFile(path string) (*os.File, os.FileInfo, string, error) {
+	resolved, err := ResolvePath(path)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	file, err := os.Open(resolved)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, "", err
+	}
+	if info.IsDir() {
+		file.Close()
+		return nil, nil, "", errors.New(path + " is a directory")
+	}
+	storeLock.RLock()
+	cached := store[resolved]
+	storeLock.RUnlock()
+	if cached != nil && cached.Size == info.Size() && cached.Modification == info.ModTime().Unix() &&
+		checksumAlgorithmOf(cached.Checksum) == utils.SHA256 {
+		return file, info, cached.Checksum, nil
+	}
+	checksum, err := utils.ChecksumsForFile(resolved, utils.SHA256)
+	if err != nil {
+		file.Close()
+		return nil, nil, "", err
+	}
+	return file, info, checksum.SHA256, nil
+}
@@ -0,0 +1,55 @@
+package lib
+
+import (
+	"strings"
+)
+
+// DryRunFile is a change an upload would make. Action is write, symlink or
+// delete, Rule the action of the first rule matching the path.
+type DryRunFile struct {
+	Path     string
+	Action   string
+	Size     int64  `json:",omitempty"`
+	Checksum string `json:",omitempty"`
+	Symlink  string `json:",omitempty"`
+	Rule     string `json:",omitempty"`
+}
+
+// DryRun reports what a validated upload would write and trigger.
+type DryRun struct {
+	Files   []DryRunFile
+	Restart bool
+	Signals []string `json:",omitempty"`
+	Hooks   []string `json:",omitempty"`
+}
+
+// dryRunReport describes the changes of a dry run transaction.
+func (t *transaction) dryRunReport() *DryRun {
+	report := &DryRun{Files: []DryRunFile{}}
+	roots := GetRoots()
+	for _, op := range t.ops {
+		file := DryRunFile{Path: clientPath(roots, op.path)}
+		switch {
+		case op.delete:
+			file.Action = "delete"
+		case len(op.target) > 0:
+			file.Action = "symlink"
+			file.Symlink = op.target
+		default:
+			file.Action = "write"
+			file.Size = op.size
+			file.Checksum = op.checksum
+		}
+		if rule := ruleFor(file.Path); rule != nil {
+			file.Rule = rule.Action
+		}
+		report.Files = append(report.Files, file)
+	}
+	plan := planChanges(t.clientPaths())
+	report.Restart = plan.restart
+	for _, rule := range plan.signals {
+		report.Signals = append(report.Signals, strings.TrimPrefix(rule.Action, actionSignal))
+	}
+	report.Hooks = triggeredHooks(t.ops)
+	return report
+}
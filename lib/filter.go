@@ -0,0 +1,63 @@
+package lib
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// FileFilter selects a page of the file index.
+type FileFilter struct {
+	// Prefix of the client paths, e.g. "static:css/"
+	Prefix string
+	// Glob with gitignore syntax matched against the client paths
+	Glob string
+	// ModifiedSince selects files modified after this Unix time
+	ModifiedSince int64
+	// Cursor is the last path of the previous page
+	Cursor string
+	// Limit is the maximum number of files of a page, 0 for all
+	Limit int
+}
+
+type ListedFile struct {
+	Path  string
+	Entry *FileEntry
+}
+
+// FilterFiles returns the files matching filter sorted by path, and the cursor
+// of the next page or an empty string if this is the last page.
+func FilterFiles(filter FileFilter) ([]ListedFile, string, error) {
+	var glob *regexp.Regexp
+	if len(filter.Glob) > 0 {
+		var err error
+		glob, err = regexp.Compile("^" + globToRegexp(strings.TrimPrefix(filter.Glob, "/")) + "$")
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	files := []ListedFile{}
+	for path, fileEntry := range ListFiles() {
+		if !strings.HasPrefix(path, filter.Prefix) {
+			continue
+		}
+		if len(filter.Cursor) > 0 && path <= filter.Cursor {
+			continue
+		}
+		if filter.ModifiedSince > 0 && fileEntry.Modification <= filter.ModifiedSince {
+			continue
+		}
+		if glob != nil && !glob.MatchString(path) {
+			continue
+		}
+		files = append(files, ListedFile{Path: path, Entry: fileEntry})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+	if filter.Limit > 0 && len(files) > filter.Limit {
+		files = files[:filter.Limit]
+		return files, files[len(files)-1].Path, nil
+	}
+	return files, "", nil
+}
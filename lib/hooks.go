@@ -0,0 +1,207 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// hookOutputLimit caps the output of a hook kept for the response. The end of
+// the output is kept, as that is where failures are reported.
+const hookOutputLimit = 64 * 1024
+
+// Hook is a command run in a backend dir after an upload changed a file in it
+// matching Pattern, or a rule with the action hook:<name>, and before the
+// backend is restarted. Pattern uses the syntax of the ignore files and is
+// optional. A Timeout in seconds stops a hanging command.
+type Hook struct {
+	Name    string
+	Pattern string
+	Command string
+	Timeout int
+	rule    *ignoreRule
+}
+
+// HookResult is the outcome of running a hook in the backend dir named Dir.
+type HookResult struct {
+	Name     string
+	Command  string
+	Dir      string
+	ExitCode int
+	Output   string
+	Error    string `json:",omitempty"`
+}
+
+func (r HookResult) failed() bool {
+	return r.ExitCode != 0 || len(r.Error) > 0
+}
+
+var hooksLock = sync.RWMutex{}
+var hooks []*Hook
+
+// LoadHooks reads and validates the hooks from the configuration. Hooks run
+// in the order of their names.
+func LoadHooks() error {
+	configured := map[string]*Hook{}
+	if err := viper.UnmarshalKey(CONFIG_HOOKS, &configured); err != nil {
+		return errors.New("invalid hooks: " + err.Error())
+	}
+	loaded := []*Hook{}
+	for name, hook := range configured {
+		if hook == nil || len(hook.Command) == 0 {
+			return errors.New("hook " + name + " has no command")
+		}
+		rule, err := parseRule(hook.Pattern)
+		if err != nil {
+			return errors.New("hook " + name + ": " + err.Error())
+		}
+		if rule != nil && rule.negate {
+			return errors.New("hook " + name + " has no valid pattern")
+		}
+		hook.Name = name
+		hook.rule = rule
+		loaded = append(loaded, hook)
+	}
+	sort.Slice(loaded, func(i, j int) bool {
+		return loaded[i].Name < loaded[j].Name
+	})
+	hooksLock.Lock()
+	hooks = loaded
+	hooksLock.Unlock()
+	return nil
+}
+
+// hookExists reports whether a hook with the given name is configured.
+func hookExists(name string) bool {
+	hooksLock.RLock()
+	defer hooksLock.RUnlock()
+	for _, hook := range hooks {
+		if hook.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether path, relative to a backend dir, triggers the hook
+// by its pattern.
+func (h *Hook) matches(rel string) bool {
+	return h.rule != nil && h.rule.matchesPath(filepath.ToSlash(rel))
+}
+
+// runHooks runs the hooks triggered by the files of a committed transaction,
+// once per backend dir. It stops at the first failing hook.
+func runHooks(ops []*fileOp) []HookResult {
+	hooksLock.RLock()
+	defer hooksLock.RUnlock()
+	if len(hooks) == 0 {
+		return nil
+	}
+	markHooksRunning(true)
+	defer markHooksRunning(false)
+	results := []HookResult{}
+	for _, hook := range hooks {
+		for _, root := range GetRoots() {
+			if !hookTriggered(hook, root, ops) {
+				continue
+			}
+			result := runHook(hook, root)
+			results = append(results, result)
+			if result.failed() {
+				return results
+			}
+		}
+	}
+	return results
+}
+
+// triggeredHooks returns the names of the hooks the files of a transaction
+// would run.
+func triggeredHooks(ops []*fileOp) []string {
+	hooksLock.RLock()
+	defer hooksLock.RUnlock()
+	names := []string{}
+	for _, hook := range hooks {
+		for _, root := range GetRoots() {
+			if hookTriggered(hook, root, ops) {
+				names = append(names, hook.Name)
+				break
+			}
+		}
+	}
+	return names
+}
+
+func hookTriggered(hook *Hook, root Root, ops []*fileOp) bool {
+	roots := GetRoots()
+	for _, op := range ops {
+		// op paths are relative with relative backend dirs
+		abs, err := filepath.Abs(op.path)
+		if err != nil || !isWithin(root.Abs, abs) {
+			continue
+		}
+		if rel, err := filepath.Rel(root.Abs, abs); err == nil && hook.matches(rel) {
+			return true
+		}
+		if ruleHook(clientPath(roots, op.path)) == hook.Name {
+			return true
+		}
+	}
+	return false
+}
+
+func runHook(hook *Hook, root Root) HookResult {
+	log.Println("Running hook " + hook.Name + " in " + root.Name + ": " + hook.Command)
+	result := HookResult{Name: hook.Name, Command: hook.Command, Dir: root.Name}
+	ctx := context.Background()
+	if hook.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(hook.Timeout)*time.Second)
+		defer cancel()
+	}
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", hook.Command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", hook.Command)
+	}
+	cmd.Dir = root.Abs
+	cmd.Env = GetBackendEnvironment()
+	// children of the shell may keep the output open after a timeout
+	cmd.WaitDelay = time.Second
+	output, err := cmd.CombinedOutput()
+	if len(output) > hookOutputLimit {
+		output = output[len(output)-hookOutputLimit:]
+	}
+	result.Output = string(output)
+	if cmd.ProcessState != nil {
+		result.ExitCode = cmd.ProcessState.ExitCode()
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		result.Error = "timed out"
+	} else if _, ok := err.(*exec.ExitError); !ok && err != nil {
+		result.Error = err.Error()
+	}
+	if result.failed() {
+		log.Printf("Hook %s failed with exit code %d %s", hook.Name, result.ExitCode, result.Error)
+	}
+	return result
+}
+
+// failedHook returns the name of the failed hook in results, if any.
+func failedHook(results []HookResult) string {
+	for _, result := range results {
+		if result.failed() {
+			return result.Name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,117 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// setupRelativeRoot configures the default backend dir ./ in a new working
+// directory and returns its absolute path.
+func setupRelativeRoot(t *testing.T) string {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(wd)
+	})
+	viper.Set(CONFIG_BACKEND_DIRS, "./")
+	abs, err := filepath.Abs(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return abs
+}
+
+func setHooks(t *testing.T, configured ...*Hook) {
+	for _, hook := range configured {
+		rule, err := parseRule(hook.Pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hook.rule = rule
+	}
+	hooksLock.Lock()
+	hooks = configured
+	hooksLock.Unlock()
+	t.Cleanup(func() {
+		hooksLock.Lock()
+		hooks = nil
+		hooksLock.Unlock()
+	})
+}
+
+func setRules(t *testing.T, configured ...*Rule) {
+	for _, rule := range configured {
+		if err := rule.compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rulesLock.Lock()
+	rules = configured
+	rulesLock.Unlock()
+	t.Cleanup(func() {
+		rulesLock.Lock()
+		rules = nil
+		rulesLock.Unlock()
+	})
+}
+
+func TestTriggeredHooksRelativeRoot(t *testing.T) {
+	setupRelativeRoot(t)
+	setHooks(t,
+		&Hook{Name: "assets", Command: "true"},
+		&Hook{Name: "npm", Pattern: "package.json", Command: "true"},
+		&Hook{Name: "pip", Pattern: "requirements.txt", Command: "true"},
+	)
+	setRules(t, &Rule{Pattern: "*.scss", Action: actionHook + "assets"})
+	tests := []struct {
+		path  string
+		hooks []string
+	}{
+		{path: "requirements.txt", hooks: []string{"pip"}},
+		{path: "web/package.json", hooks: []string{"npm"}},
+		{path: "css/app.scss", hooks: []string{"assets"}},
+		{path: "app.py", hooks: []string{}},
+	}
+	for _, test := range tests {
+		resolved, err := ResolvePath(test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		triggered := triggeredHooks([]*fileOp{{path: resolved}})
+		if len(triggered) != len(test.hooks) || (len(triggered) > 0 && triggered[0] != test.hooks[0]) {
+			t.Errorf("triggeredHooks(%q) = %v, want %v", test.path, triggered, test.hooks)
+		}
+	}
+}
+
+func TestRunHooksRelativeRoot(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hook command requires sh")
+	}
+	abs := setupRelativeRoot(t)
+	setHooks(t, &Hook{Name: "pip", Pattern: "requirements.txt", Command: "touch installed"})
+	resolved, err := ResolvePath("requirements.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := runHooks([]*fileOp{{path: resolved}})
+	if len(results) != 1 || results[0].failed() {
+		t.Fatalf("runHooks() = %+v, want one successful hook", results)
+	}
+	if results[0].Dir != filepath.Base(abs) {
+		t.Errorf("hook ran in %q, want %q", results[0].Dir, filepath.Base(abs))
+	}
+	if _, err := os.Stat(filepath.Join(abs, "installed")); err != nil {
+		t.Errorf("hook did not run in the backend dir: %s", err)
+	}
+}
@@ -0,0 +1,229 @@
+package lib
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+var ErrIgnored = errors.New("path is excluded by the ignore rules")
+
+// ignoreRule is a single compiled line of a gitignore style file.
+type ignoreRule struct {
+	pattern *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// ignoreRules holds the rules of one backend dir. Paths are matched relative
+// to root.
+type ignoreRules struct {
+	root  string
+	rules []ignoreRule
+}
+
+var ignoreLock = sync.RWMutex{}
+var ignoreRoots []*ignoreRules
+
+// IsIgnored reports whether path is excluded from indexing and uploads, either
+// by the ignore rules of its backend dir or because it belongs to .git or an
+// upload in progress.
+func IsIgnored(path string, isDir bool) bool {
+	base := filepath.Base(path)
+	if strings.HasPrefix(base, stagingPrefix) {
+		// ignore files of uploads in progress
+		return true
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	ignoreLock.RLock()
+	loaded := ignoreRoots != nil
+	ignoreLock.RUnlock()
+	if !loaded {
+		LoadIgnoreRules()
+	}
+	ignoreLock.RLock()
+	defer ignoreLock.RUnlock()
+	for _, root := range ignoreRoots {
+		if rel, err := filepath.Rel(root.root, abs); err == nil && isWithin(root.root, abs) && rel != "." {
+			return root.matches(filepath.ToSlash(rel), isDir)
+		}
+	}
+	return false
+}
+
+// LoadIgnoreRules reads the ignore files of all backend dirs and the extra
+// patterns from the configuration.
+func LoadIgnoreRules() {
+	extra := strings.Fields(viper.GetString(CONFIG_IGNORE_PATTERNS))
+	roots := []*ignoreRules{}
+	for _, root := range GetRoots() {
+		abs := root.Abs
+		rules := &ignoreRules{root: abs}
+		// nested .git dirs are never synced
+		rules.add(".git/")
+		for _, name := range strings.Fields(viper.GetString(CONFIG_IGNORE_FILES)) {
+			rules.load(filepath.Join(abs, name))
+		}
+		for _, pattern := range extra {
+			rules.add(pattern)
+		}
+		roots = append(roots, rules)
+	}
+	ignoreLock.Lock()
+	ignoreRoots = roots
+	ignoreLock.Unlock()
+}
+
+// reloadIgnoreRulesFor reloads the rules if path is one of the ignore files.
+func reloadIgnoreRulesFor(path string) {
+	base := filepath.Base(path)
+	for _, name := range strings.Fields(viper.GetString(CONFIG_IGNORE_FILES)) {
+		if base == name {
+			log.Println("Reloading ignore rules after change of " + path)
+			LoadIgnoreRules()
+			return
+		}
+	}
+}
+
+func (r *ignoreRules) load(path string) {
+	file, err := os.Open(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println(err)
+		}
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		r.add(scanner.Text())
+	}
+}
+
+// add compiles a gitignore style pattern line and appends it to the rules.
+func (r *ignoreRules) add(line string) {
+	rule, err := parseRule(line)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if rule != nil {
+		r.rules = append(r.rules, *rule)
+	}
+}
+
+// parseRule compiles a gitignore style pattern line. It returns nil for blank
+// lines and comments.
+func parseRule(line string) (*ignoreRule, error) {
+	line = strings.TrimRight(line, " \t\r")
+	if len(line) == 0 || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+	rule := ignoreRule{}
+	// a leading \# or \! is unescaped by globToRegexp like any other character
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	// patterns with a slash are relative to the root, others match at any level
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if len(line) == 0 {
+		return nil, nil
+	}
+	expr := globToRegexp(line)
+	if !anchored {
+		expr = "(.*/)?" + expr
+	}
+	pattern, err := regexp.Compile("^" + expr + "$")
+	if err != nil {
+		return nil, errors.New("invalid pattern " + line + ": " + err.Error())
+	}
+	rule.pattern = pattern
+	return &rule, nil
+}
+
+// matches applies the rules to rel and all its parent dirs. Like git, a file
+// in an ignored dir cannot be included again.
+func (r *ignoreRules) matches(rel string, isDir bool) bool {
+	parts := strings.Split(rel, "/")
+	for i := range parts {
+		last := i == len(parts)-1
+		if r.match(strings.Join(parts[:i+1], "/"), !last || isDir) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *ignoreRules) match(rel string, isDir bool) bool {
+	ignored := false
+	for _, rule := range r.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.pattern.MatchString(rel) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// matchesPath applies a single rule to rel like ignoreRules.matches does.
+func (rule *ignoreRule) matchesPath(rel string) bool {
+	rules := ignoreRules{rules: []ignoreRule{*rule}}
+	return rules.matches(rel, false)
+}
+
+// globToRegexp translates a gitignore glob into a regular expression.
+func globToRegexp(glob string) string {
+	var expr strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			expr.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			expr.WriteString(".*")
+			i++
+		case c == '*':
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				expr.WriteString(regexp.QuoteMeta(string(c)))
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + class + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			expr.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return expr.String()
+}
@@ -0,0 +1,97 @@
+package lib
+
+import (
+	"testing"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob string
+		expr string
+	}{
+		{glob: "foo.txt", expr: `foo\.txt`},
+		{glob: "*.log", expr: `[^/]*\.log`},
+		{glob: "file?", expr: `file[^/]`},
+		{glob: "**/foo", expr: `(.*/)?foo`},
+		{glob: "foo/**", expr: `foo/.*`},
+		{glob: "a/**/b", expr: `a/(.*/)?b`},
+		{glob: "[abc].txt", expr: `[abc]\.txt`},
+		{glob: "[!abc].txt", expr: `[^abc]\.txt`},
+		{glob: "[abc", expr: `\[abc`},
+		{glob: `\*.txt`, expr: `\*\.txt`},
+		{glob: `\?`, expr: `\?`},
+		{glob: `a\[b]`, expr: `a\[b\]`},
+	}
+	for _, test := range tests {
+		if expr := globToRegexp(test.glob); expr != test.expr {
+			t.Errorf("globToRegexp(%q) = %q, want %q", test.glob, expr, test.expr)
+		}
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	for _, line := range []string{"", "   ", "# comment", "/", "//"} {
+		if rule, err := parseRule(line); rule != nil || err != nil {
+			t.Errorf("parseRule(%q) = %v, %v, want no rule", line, rule, err)
+		}
+	}
+	if _, err := parseRule("[z-a]"); err == nil {
+		t.Errorf("parseRule(%q) succeeded, want error", "[z-a]")
+	}
+	rule, err := parseRule("!build/ ")
+	if err != nil || rule == nil {
+		t.Fatalf("parseRule(%q) = %v, %v", "!build/ ", rule, err)
+	}
+	if !rule.negate || !rule.dirOnly {
+		t.Errorf("parseRule(%q) = negate %v, dir only %v, want both", "!build/ ", rule.negate, rule.dirOnly)
+	}
+}
+
+func TestIgnoreRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []string
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{name: "unanchored matches at any level", rules: []string{"*.log"}, path: "a/b/debug.log", want: true},
+		{name: "unanchored matches in root", rules: []string{"*.log"}, path: "debug.log", want: true},
+		{name: "star stays within a segment", rules: []string{"a*c"}, path: "ab/c", want: false},
+		{name: "leading slash anchors", rules: []string{"/foo"}, path: "foo", want: true},
+		{name: "leading slash anchors to root", rules: []string{"/foo"}, path: "a/foo", want: false},
+		{name: "inner slash anchors", rules: []string{"a/b"}, path: "a/b", want: true},
+		{name: "inner slash anchors to root", rules: []string{"a/b"}, path: "x/a/b", want: false},
+		{name: "double star prefix", rules: []string{"**/foo"}, path: "foo", want: true},
+		{name: "double star prefix nested", rules: []string{"**/foo"}, path: "a/b/foo", want: true},
+		{name: "double star prefix with anchored rest", rules: []string{"**/a/b"}, path: "x/a/b", want: true},
+		{name: "double star in the middle", rules: []string{"a/**/b"}, path: "a/b", want: true},
+		{name: "double star in the middle nested", rules: []string{"a/**/b"}, path: "a/x/y/b", want: true},
+		{name: "double star suffix", rules: []string{"a/**"}, path: "a/x/y", want: true},
+		{name: "dir only skips files", rules: []string{"build/"}, path: "build", want: false},
+		{name: "dir only matches dirs", rules: []string{"build/"}, path: "build", isDir: true, want: true},
+		{name: "dir only matches files below", rules: []string{"build/"}, path: "a/build/out.js", want: true},
+		{name: "file in ignored dir", rules: []string{"/vendor"}, path: "vendor/a/b.go", want: true},
+		{name: "negation", rules: []string{"*.log", "!keep.log"}, path: "keep.log", want: false},
+		{name: "negation keeps others ignored", rules: []string{"*.log", "!keep.log"}, path: "debug.log", want: true},
+		{name: "later rule wins", rules: []string{"!keep.log", "*.log"}, path: "keep.log", want: true},
+		{name: "negation under ignored parent", rules: []string{"build/", "!build/keep.txt"}, path: "build/keep.txt", want: true},
+		{name: "negation under ignored parent pattern", rules: []string{"/out", "!/out/keep"}, path: "out/keep", want: true},
+		{name: "negation under ignored parent glob", rules: []string{"/out/*", "!/out/keep"}, path: "out/keep", want: false},
+		{name: "escaped hash", rules: []string{`\#notes`}, path: "#notes", want: true},
+		{name: "escaped bang", rules: []string{`\!important`}, path: "!important", want: true},
+		{name: "escaped star is literal", rules: []string{`\*.txt`}, path: "a.txt", want: false},
+		{name: "escaped star matches star", rules: []string{`\*.txt`}, path: "*.txt", want: true},
+		{name: "character class", rules: []string{"[ab].txt"}, path: "b.txt", want: true},
+		{name: "negated character class", rules: []string{"[!ab].txt"}, path: "b.txt", want: false},
+	}
+	for _, test := range tests {
+		rules := ignoreRules{}
+		for _, line := range test.rules {
+			rules.add(line)
+		}
+		if got := rules.matches(test.path, test.isDir); got != test.want {
+			t.Errorf("%s: %v matching %q = %v, want %v", test.name, test.rules, test.path, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package lib
+
+import (
+	"os"
+	"syscall"
+)
+
+func fileInode(f os.FileInfo) uint64 {
+	if stat, ok := f.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
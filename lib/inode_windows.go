@@ -0,0 +1,9 @@
+package lib
+
+import (
+	"os"
+)
+
+func fileInode(f os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,252 @@
+package lib
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const maxSymlinks = 40
+
+var ErrOutsideRoots = errors.New("path is outside of the backend directories")
+
+// rootSeparator separates the name of a backend dir from the path within it
+// in the paths exchanged with clients, e.g. "static:css/app.css".
+const rootSeparator = ":"
+
+// Root is a named backend dir. Clients address files relative to a root so
+// the container layout stays hidden.
+type Root struct {
+	Name string
+	Dir  string
+	Abs  string
+}
+
+// GetRoots returns the backend dirs. Entries of backend_dirs are either a dir
+// or name=dir; unnamed dirs are named after their base name. Paths without a
+// root name refer to the first root.
+func GetRoots() []Root {
+	roots := []Root{}
+	for _, entry := range GetAppDirs() {
+		name := ""
+		dir := entry
+		if i := strings.Index(entry, "="); i > 0 {
+			name = entry[:i]
+			dir = entry[i+1:]
+		}
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			continue
+		}
+		if len(name) == 0 {
+			name = filepath.Base(abs)
+		}
+		roots = append(roots, Root{Name: name, Dir: dir, Abs: abs})
+	}
+	return roots
+}
+
+// ValidateRoots reports backend dirs whose names clients could not tell apart.
+func ValidateRoots() error {
+	dirs := map[string]string{}
+	for _, root := range GetRoots() {
+		if strings.Contains(root.Name, rootSeparator) {
+			return errors.New("invalid backend dir name " + root.Name)
+		}
+		if dir, found := dirs[root.Name]; found {
+			return errors.New("backend dirs " + dir + " and " + root.Dir + " are both named " + root.Name)
+		}
+		dirs[root.Name] = root.Dir
+	}
+	return nil
+}
+
+// GetRootDirs returns the dirs of all roots.
+func GetRootDirs() []string {
+	dirs := []string{}
+	for _, root := range GetRoots() {
+		dirs = append(dirs, root.Dir)
+	}
+	return dirs
+}
+
+// splitRoot returns the root a client path refers to and the path relative to
+// that root.
+func splitRoot(roots []Root, path string) (Root, string, error) {
+	if len(roots) == 0 {
+		return Root{}, "", ErrOutsideRoots
+	}
+	if i := strings.Index(path, rootSeparator); i > 0 {
+		if root, found := rootNamed(roots, path[:i]); found {
+			return root, path[i+1:], nil
+		}
+	}
+	return roots[0], path, nil
+}
+
+func rootNamed(roots []Root, name string) (Root, bool) {
+	for _, root := range roots {
+		if root.Name == name {
+			return root, true
+		}
+	}
+	return Root{}, false
+}
+
+// ClientPath returns the path under which a file of a backend dir is known to
+// clients: relative to its root and prefixed with the root name, except for
+// the first root. Files of the first root whose path starts like a root name
+// are prefixed as well, so "static:x" in the first root does not refer to the
+// static root.
+func ClientPath(path string) string {
+	return clientPath(GetRoots(), path)
+}
+
+func clientPath(roots []Root, path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	for i, root := range roots {
+		if !isWithin(root.Abs, abs) {
+			continue
+		}
+		rel, err := filepath.Rel(root.Abs, abs)
+		if err != nil {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		if i == 0 && !hasRootPrefix(roots, rel) {
+			return rel
+		}
+		return root.Name + rootSeparator + rel
+	}
+	return path
+}
+
+func hasRootPrefix(roots []Root, path string) bool {
+	if i := strings.Index(path, rootSeparator); i > 0 {
+		_, found := rootNamed(roots, path[:i])
+		return found
+	}
+	return false
+}
+
+// ResolvePath maps a client path to the file within its root, also after
+// following symlinks, and returns its location on disk.
+func ResolvePath(path string) (string, error) {
+	return resolvePath(path, true)
+}
+
+// ResolveParentPath is like ResolvePath but does not follow a symlink in the
+// last path element. Use it for operations acting on the link itself.
+func ResolveParentPath(path string) (string, error) {
+	return resolvePath(path, false)
+}
+
+func resolvePath(path string, followLast bool) (string, error) {
+	if len(path) == 0 {
+		return "", errors.New("empty path")
+	}
+	root, rel, err := splitRoot(GetRoots(), path)
+	if err != nil {
+		return "", err
+	}
+	rel = filepath.Clean(filepath.FromSlash(rel))
+	if filepath.IsAbs(rel) || !isWithin(root.Abs, filepath.Join(root.Abs, rel)) {
+		return "", ErrOutsideRoots
+	}
+	resolved := filepath.Join(root.Dir, rel)
+	if err := confine(root, resolved, followLast); err != nil {
+		return "", err
+	}
+	return resolved, nil
+}
+
+// confineAny checks that path, a location on disk, lies within any root.
+func confineAny(path string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	for _, root := range GetRoots() {
+		if isWithin(root.Abs, abs) {
+			return confine(root, abs, true)
+		}
+	}
+	return ErrOutsideRoots
+}
+
+// confine checks that path, a location on disk, stays within root after
+// following symlinks.
+func confine(root Root, path string, followLast bool) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	realRoot, err := filepath.EvalSymlinks(root.Abs)
+	if err != nil {
+		return err
+	}
+	var real string
+	if followLast {
+		real, err = evalExistingSymlinks(abs)
+	} else {
+		real, err = evalExistingSymlinks(filepath.Dir(abs))
+		real = filepath.Join(real, filepath.Base(abs))
+	}
+	if err != nil {
+		return err
+	}
+	if !isWithin(realRoot, real) {
+		return ErrOutsideRoots
+	}
+	return nil
+}
+
+// evalExistingSymlinks resolves symlinks in the longest existing prefix of
+// path and appends the remaining, not yet existing, elements unchanged.
+func evalExistingSymlinks(path string) (string, error) {
+	rest := ""
+	links := 0
+	for {
+		real, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(real, rest), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		if info, lerr := os.Lstat(path); lerr == nil && info.Mode()&os.ModeSymlink != 0 {
+			// dangling symlink, follow it to where it would be created
+			links++
+			if links > maxSymlinks {
+				return "", errors.New("too many levels of symbolic links")
+			}
+			target, err := os.Readlink(path)
+			if err != nil {
+				return "", err
+			}
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(filepath.Dir(path), target)
+			}
+			path = target
+			continue
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return "", err
+		}
+		rest = filepath.Join(filepath.Base(path), rest)
+		path = parent
+	}
+}
+
+func isWithin(root string, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,211 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// setupRoot configures a single backend dir with a sibling dir outside of it
+// and returns both.
+func setupRoot(t *testing.T) (string, string) {
+	base := t.TempDir()
+	root := filepath.Join(base, "app")
+	outside := filepath.Join(base, "outside")
+	for _, dir := range []string{filepath.Join(root, "sub"), outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	viper.Set(CONFIG_BACKEND_DIRS, root)
+	return root, outside
+}
+
+func symlink(t *testing.T, target string, path string) {
+	if err := os.Symlink(target, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolvePath(t *testing.T) {
+	root, _ := setupRoot(t)
+	tests := []struct {
+		path     string
+		resolved string
+		err      bool
+	}{
+		{path: "a.txt", resolved: "a.txt"},
+		{path: "sub/a.txt", resolved: "sub/a.txt"},
+		{path: "sub/../a.txt", resolved: "a.txt"},
+		{path: "new/dir/a.txt", resolved: "new/dir/a.txt"},
+		{path: "", err: true},
+		{path: "../a.txt", err: true},
+		{path: "..", err: true},
+		{path: "sub/../../a.txt", err: true},
+		{path: "sub/../../app/a.txt", resolved: "a.txt"},
+		{path: "/etc/passwd", err: true},
+		{path: filepath.Join(root, "a.txt"), err: true},
+	}
+	for _, test := range tests {
+		resolved, err := ResolvePath(test.path)
+		if test.err {
+			if err == nil {
+				t.Errorf("ResolvePath(%q) = %q, want error", test.path, resolved)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ResolvePath(%q) failed: %s", test.path, err)
+			continue
+		}
+		if want := filepath.Join(root, filepath.FromSlash(test.resolved)); resolved != want {
+			t.Errorf("ResolvePath(%q) = %q, want %q", test.path, resolved, want)
+		}
+	}
+}
+
+func TestResolvePathSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks require privileges on windows")
+	}
+	root, outside := setupRoot(t)
+	symlink(t, outside, filepath.Join(root, "out"))
+	symlink(t, "sub", filepath.Join(root, "in"))
+	symlink(t, filepath.Join(outside, "missing"), filepath.Join(root, "dangling-out"))
+	symlink(t, "sub/missing", filepath.Join(root, "dangling-in"))
+	symlink(t, "dangling-out", filepath.Join(root, "chain-out"))
+	symlink(t, "loop-b", filepath.Join(root, "loop-a"))
+	symlink(t, "loop-a", filepath.Join(root, "loop-b"))
+
+	tests := []struct {
+		path       string
+		followLast bool
+		err        bool
+	}{
+		{path: "out/a.txt", followLast: true, err: true},
+		{path: "out/a.txt", followLast: false, err: true},
+		{path: "out", followLast: true, err: true},
+		{path: "out", followLast: false},
+		{path: "in/a.txt", followLast: true},
+		{path: "in/new/a.txt", followLast: true},
+		{path: "dangling-out", followLast: true, err: true},
+		{path: "dangling-out", followLast: false},
+		{path: "dangling-in", followLast: true},
+		{path: "chain-out", followLast: true, err: true},
+		{path: "loop-a", followLast: true, err: true},
+		{path: "loop-a/a.txt", followLast: true, err: true},
+	}
+	for _, test := range tests {
+		var err error
+		if test.followLast {
+			_, err = ResolvePath(test.path)
+		} else {
+			_, err = ResolveParentPath(test.path)
+		}
+		if test.err && err == nil {
+			t.Errorf("resolving %q (follow %v) succeeded, want error", test.path, test.followLast)
+		}
+		if !test.err && err != nil {
+			t.Errorf("resolving %q (follow %v) failed: %s", test.path, test.followLast, err)
+		}
+	}
+}
+
+func TestEvalExistingSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks require privileges on windows")
+	}
+	root, outside := setupRoot(t)
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	realOutside, err := filepath.EvalSymlinks(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	symlink(t, filepath.Join(outside, "missing"), filepath.Join(root, "dangling"))
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: filepath.Join(root, "sub"), want: filepath.Join(realRoot, "sub")},
+		{path: filepath.Join(root, "sub", "new", "a.txt"), want: filepath.Join(realRoot, "sub", "new", "a.txt")},
+		{path: filepath.Join(root, "dangling"), want: filepath.Join(realOutside, "missing")},
+		{path: filepath.Join(root, "dangling", "a.txt"), want: filepath.Join(realOutside, "missing", "a.txt")},
+	}
+	for _, test := range tests {
+		real, err := evalExistingSymlinks(test.path)
+		if err != nil {
+			t.Errorf("evalExistingSymlinks(%q) failed: %s", test.path, err)
+			continue
+		}
+		if real != test.want {
+			t.Errorf("evalExistingSymlinks(%q) = %q, want %q", test.path, real, test.want)
+		}
+	}
+}
+
+func TestValidateRoots(t *testing.T) {
+	tests := []struct {
+		dirs string
+		err  bool
+	}{
+		{dirs: "app"},
+		{dirs: "a/lib b/static"},
+		{dirs: "a/lib other=b/lib"},
+		{dirs: "a/lib b/lib", err: true},
+		{dirs: "lib=a b/lib", err: true},
+		{dirs: "a:b=dir", err: true},
+	}
+	defer viper.Set(CONFIG_BACKEND_DIRS, "")
+	for _, test := range tests {
+		viper.Set(CONFIG_BACKEND_DIRS, test.dirs)
+		err := ValidateRoots()
+		if test.err && err == nil {
+			t.Errorf("ValidateRoots() with %q succeeded, want error", test.dirs)
+		}
+		if !test.err && err != nil {
+			t.Errorf("ValidateRoots() with %q failed: %s", test.dirs, err)
+		}
+	}
+}
+
+func TestClientPath(t *testing.T) {
+	base := t.TempDir()
+	app := filepath.Join(base, "app")
+	static := filepath.Join(base, "public")
+	for _, dir := range []string{app, static} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	viper.Set(CONFIG_BACKEND_DIRS, app+" static="+static)
+	tests := []struct {
+		path   string
+		client string
+	}{
+		{path: filepath.Join(app, "a.txt"), client: "a.txt"},
+		{path: filepath.Join(app, "sub", "a.txt"), client: "sub/a.txt"},
+		{path: filepath.Join(app, "x:y"), client: "x:y"},
+		{path: filepath.Join(app, "static:x"), client: "app:static:x"},
+		{path: filepath.Join(app, "app:x"), client: "app:app:x"},
+		{path: filepath.Join(static, "css", "app.css"), client: "static:css/app.css"},
+	}
+	for _, test := range tests {
+		client := ClientPath(test.path)
+		if client != test.client {
+			t.Errorf("ClientPath(%q) = %q, want %q", test.path, client, test.client)
+			continue
+		}
+		resolved, err := ResolvePath(client)
+		if err != nil {
+			t.Errorf("ResolvePath(%q) failed: %s", client, err)
+		} else if resolved != test.path {
+			t.Errorf("ResolvePath(%q) = %q, want %q", client, resolved, test.path)
+		}
+	}
+}
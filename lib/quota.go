@@ -0,0 +1,136 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/viper"
+)
+
+// QuotaError reports an exceeded upload limit. Limit is the name of the
+// configuration key, Max its value and Actual the size or count that exceeded
+// it. For min_free_space Actual is the space that would remain.
+type QuotaError struct {
+	Limit  string
+	Max    int64
+	Actual int64
+}
+
+func (e *QuotaError) Error() string {
+	if e.Limit == CONFIG_MIN_FREE_SPACE {
+		return fmt.Sprintf("%s of %d not met: %d", e.Limit, e.Max, e.Actual)
+	}
+	return fmt.Sprintf("%s of %d exceeded: %d", e.Limit, e.Max, e.Actual)
+}
+
+// quotaLimit returns the configured limit or 0 if it is disabled.
+func quotaLimit(limit string) int64 {
+	max := viper.GetInt64(limit)
+	if max < 0 {
+		return 0
+	}
+	return max
+}
+
+// LimitRequest wraps a request body so reading more than max_request_size
+// bytes fails with a QuotaError.
+func LimitRequest(r io.Reader) io.Reader {
+	max := quotaLimit(CONFIG_MAX_REQUEST_SIZE)
+	if max == 0 {
+		return r
+	}
+	return &limitedReader{r: r, limit: CONFIG_MAX_REQUEST_SIZE, max: max}
+}
+
+// limitedReader fails with a QuotaError once more than max bytes were read.
+type limitedReader struct {
+	r     io.Reader
+	limit string
+	max   int64
+	read  int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.read > l.max {
+		return 0, &QuotaError{Limit: l.limit, Max: l.max, Actual: l.read}
+	}
+	// read one byte more than allowed to detect an exceeded limit
+	if remaining := l.max - l.read + 1; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.read > l.max {
+		return n, &QuotaError{Limit: l.limit, Max: l.max, Actual: l.read}
+	}
+	return n, err
+}
+
+// checkFileQuota checks a file of the given size, if known, against
+// max_file_size and min_free_space before it is written to dir.
+func checkFileQuota(dir string, size int64) error {
+	if max := quotaLimit(CONFIG_MAX_FILE_SIZE); max > 0 && size > max {
+		return &QuotaError{Limit: CONFIG_MAX_FILE_SIZE, Max: max, Actual: size}
+	}
+	reserve := quotaLimit(CONFIG_MIN_FREE_SPACE)
+	if reserve == 0 {
+		return nil
+	}
+	free, err := freeSpace(dir)
+	if err != nil || free < 0 {
+		// free space is unknown
+		return nil
+	}
+	if size < 0 {
+		size = 0
+	}
+	if free-size < reserve {
+		return &QuotaError{Limit: CONFIG_MIN_FREE_SPACE, Max: reserve, Actual: free - size}
+	}
+	return nil
+}
+
+// limitFile wraps the content of a single file so reading more than
+// max_file_size bytes fails with a QuotaError.
+func limitFile(r io.Reader) io.Reader {
+	max := quotaLimit(CONFIG_MAX_FILE_SIZE)
+	if max == 0 {
+		return r
+	}
+	return &limitedReader{r: r, limit: CONFIG_MAX_FILE_SIZE, max: max}
+}
+
+// checkBatchQuota checks the number of files of a transaction against
+// max_batch_files.
+func (t *transaction) checkBatchQuota() error {
+	if max := quotaLimit(CONFIG_MAX_BATCH_FILES); max > 0 && int64(len(t.ops)) >= max {
+		return &QuotaError{Limit: CONFIG_MAX_BATCH_FILES, Max: max, Actual: int64(len(t.ops)) + 1}
+	}
+	return nil
+}
+
+// checkTotalQuota checks the size of the backend dirs after the transaction
+// against max_total_size. It is based on the file index.
+func (t *transaction) checkTotalQuota() error {
+	max := quotaLimit(CONFIG_MAX_TOTAL_SIZE)
+	if max == 0 {
+		return nil
+	}
+	total := int64(0)
+	storeLock.RLock()
+	for _, fileEntry := range store {
+		total += fileEntry.Size
+	}
+	storeLock.RUnlock()
+	for _, op := range t.ops {
+		if info, err := os.Lstat(op.path); err == nil {
+			total -= info.Size()
+		}
+		total += op.size
+	}
+	if total > max {
+		return &QuotaError{Limit: CONFIG_MAX_TOTAL_SIZE, Max: max, Actual: total}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package lib
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+var restartLock = sync.Mutex{}
+var restartTimer *time.Timer
+var restartIDs = 0
+var pendingRestartID = 0
+var lastRestartID = 0
+
+// restartQuietPeriod is how long no further restart has to be requested
+// before a pending restart is carried out.
+func restartQuietPeriod() time.Duration {
+	return time.Duration(viper.GetInt(CONFIG_RESTART_QUIET_PERIOD)) * time.Millisecond
+}
+
+// RequestRestart restarts or reloads the backend once no further restart was
+// requested for restart_quiet_period. Requests within the quiet period share
+// the pending restart. It returns the ID of the restart and RESTART_PENDING,
+// or the kind of restart if it happened right away.
+func RequestRestart() (int, string) {
+	delay := restartQuietPeriod()
+	if delay <= 0 {
+		restartLock.Lock()
+		restartIDs++
+		id := restartIDs
+		restartLock.Unlock()
+		kind := ReloadApp()
+		finishRestart(id)
+		return id, kind
+	}
+	return scheduleRestart(delay), RESTART_PENDING
+}
+
+// scheduleRestart postpones the pending restart to delay from now, or
+// schedules a new one.
+func scheduleRestart(delay time.Duration) int {
+	restartLock.Lock()
+	defer restartLock.Unlock()
+	if restartTimer != nil && restartTimer.Stop() {
+		restartTimer.Reset(delay)
+		return pendingRestartID
+	}
+	restartIDs++
+	id := restartIDs
+	pendingRestartID = id
+	log.Println("Scheduled restart " + strconv.Itoa(id))
+	restartTimer = time.AfterFunc(delay, func() {
+		restartLock.Lock()
+		// a restart scheduled while this one waited for the lock stays pending
+		if pendingRestartID == id {
+			restartTimer = nil
+			pendingRestartID = 0
+		}
+		restartLock.Unlock()
+		ReloadApp()
+		finishRestart(id)
+	})
+	return id
+}
+
+func finishRestart(id int) {
+	restartLock.Lock()
+	if id > lastRestartID {
+		lastRestartID = id
+	}
+	restartLock.Unlock()
+}
+
+// restartState returns the IDs of the last carried out and of the pending
+// restart.
+func restartState() (int, int) {
+	restartLock.Lock()
+	defer restartLock.Unlock()
+	return lastRestartID, pendingRestartID
+}
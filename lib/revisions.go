@@ -0,0 +1,269 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const revisionFile = "revision.json"
+
+// RevisionFile is a file touched by a revision. Its previous content, if it
+// Existed, is kept in the revision dir under the file's position in Files.
+type RevisionFile struct {
+	Path    string
+	Existed bool
+}
+
+// Revision is a committed batch and the pre-images of the files it touched.
+type Revision struct {
+	ID    int
+	Time  int64
+	Files []RevisionFile
+}
+
+var ErrUnknownRevision = errors.New("unknown revision")
+
+var revisionLock = sync.Mutex{}
+
+// revisionsEnabled reports whether committed batches are kept as revisions.
+func revisionsEnabled() bool {
+	return viper.GetInt(CONFIG_REVISION_LIMIT) > 0
+}
+
+func revisionDir(id int) string {
+	return filepath.Join(viper.GetString(CONFIG_REVISION_DIR), strconv.Itoa(id))
+}
+
+// recordRevision moves the backups of a committed transaction into a new
+// revision and returns its ID.
+func recordRevision(ops []*fileOp) (int, error) {
+	revisionLock.Lock()
+	defer revisionLock.Unlock()
+	ids, err := revisionIDs()
+	if err != nil {
+		return 0, err
+	}
+	id := 1
+	if len(ids) > 0 {
+		id = ids[len(ids)-1] + 1
+	}
+	dir := revisionDir(id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+	revision := Revision{ID: id, Time: time.Now().Unix(), Files: []RevisionFile{}}
+	seen := map[string]bool{}
+	roots := GetRoots()
+	for _, op := range ops {
+		if seen[op.path] || (op.delete && len(op.backup) == 0) {
+			// only the first pre-image of a path counts
+			continue
+		}
+		seen[op.path] = true
+		file := RevisionFile{Path: clientPath(roots, op.path)}
+		if len(op.backup) > 0 {
+			if err := moveFile(op.backup, filepath.Join(dir, strconv.Itoa(len(revision.Files)))); err != nil {
+				os.RemoveAll(dir)
+				return 0, err
+			}
+			op.backup = ""
+			file.Existed = true
+		}
+		revision.Files = append(revision.Files, file)
+	}
+	data, err := json.Marshal(revision)
+	if err != nil {
+		return 0, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, revisionFile), data, 0644); err != nil {
+		return 0, err
+	}
+	pruneRevisions(append(ids, id))
+	log.Println("Recorded revision " + strconv.Itoa(id))
+	return id, nil
+}
+
+// ListRevisions returns the kept revisions, newest first.
+func ListRevisions() ([]Revision, error) {
+	revisionLock.Lock()
+	defer revisionLock.Unlock()
+	ids, err := revisionIDs()
+	if err != nil {
+		return nil, err
+	}
+	revisions := []Revision{}
+	for i := len(ids) - 1; i >= 0; i-- {
+		revision, err := loadRevision(ids[i])
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		revisions = append(revisions, revision)
+	}
+	return revisions, nil
+}
+
+// RollbackRevision restores the files to their state before revision id,
+// undoing it and all later revisions. The rollback is committed as a new
+// revision and follows the normal restart rules. An error is returned if the
+// revision is unknown or the revisions cannot be read; no files are changed
+// then.
+func RollbackRevision(id int) (Status, error) {
+	revisionLock.Lock()
+	ids, err := revisionIDs()
+	if err != nil {
+		revisionLock.Unlock()
+		return Status{}, err
+	}
+	// the oldest pre-image of each path wins, so apply newest first
+	preImages := map[string]RevisionFile{}
+	preImagePaths := map[string]string{}
+	found := false
+	for i := len(ids) - 1; i >= 0 && ids[i] >= id; i-- {
+		revision, err := loadRevision(ids[i])
+		if err != nil {
+			revisionLock.Unlock()
+			return Status{}, err
+		}
+		found = found || ids[i] == id
+		for index, file := range revision.Files {
+			preImages[file.Path] = file
+			preImagePaths[file.Path] = filepath.Join(revisionDir(ids[i]), strconv.Itoa(index))
+		}
+	}
+	revisionLock.Unlock()
+	if !found {
+		return Status{}, ErrUnknownRevision
+	}
+
+	status := Status{}
+	updated := 0
+	deleted := 0
+	tx := newTransaction()
+	for path, file := range preImages {
+		log.Println("Restoring file: " + path)
+		var err error
+		if file.Existed {
+			err = restorePreImage(tx, path, preImagePaths[path])
+			updated++
+		} else {
+			err = tx.Delete(path)
+			deleted++
+		}
+		if err != nil {
+			log.Println(path + ": " + err.Error())
+			status.AddError(path, err)
+		}
+	}
+	return commitFiles(tx, status, updated, deleted), nil
+}
+
+func restorePreImage(tx *transaction, path string, preImage string) error {
+	info, err := os.Lstat(preImage)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(preImage)
+		if err != nil {
+			return err
+		}
+		return tx.Symlink(path, target)
+	}
+	file, err := os.Open(preImage)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return tx.Write(path, file, &FileEntry{Size: info.Size(), Mode: info.Mode(), Modification: info.ModTime().Unix()})
+}
+
+func loadRevision(id int) (Revision, error) {
+	data, err := ioutil.ReadFile(filepath.Join(revisionDir(id), revisionFile))
+	if err != nil {
+		return Revision{}, err
+	}
+	revision := Revision{}
+	err = json.Unmarshal(data, &revision)
+	return revision, err
+}
+
+// revisionIDs returns the IDs of the kept revisions in ascending order.
+func revisionIDs() ([]int, error) {
+	entries, err := ioutil.ReadDir(viper.GetString(CONFIG_REVISION_DIR))
+	if os.IsNotExist(err) {
+		return []int{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ids := []int{}
+	for _, entry := range entries {
+		if id, err := strconv.Atoi(entry.Name()); err == nil && entry.IsDir() {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// pruneRevisions removes the oldest revisions beyond the configured limit.
+func pruneRevisions(ids []int) {
+	limit := viper.GetInt(CONFIG_REVISION_LIMIT)
+	for len(ids) > limit {
+		if err := os.RemoveAll(revisionDir(ids[0])); err != nil {
+			log.Println(err)
+		}
+		ids = ids[1:]
+	}
+}
+
+// moveFile renames src to dst, copying it if both are on different devices.
+func moveFile(src string, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(target, dst); err != nil {
+			return err
+		}
+		return os.Remove(src)
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	os.Chtimes(dst, info.ModTime(), info.ModTime())
+	return os.Remove(src)
+}
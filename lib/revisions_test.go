@@ -0,0 +1,54 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func setupRevisions(t *testing.T) {
+	viper.Set(CONFIG_REVISION_DIR, t.TempDir())
+	viper.Set(CONFIG_REVISION_LIMIT, 10)
+	t.Cleanup(func() {
+		viper.Set(CONFIG_REVISION_LIMIT, 0)
+	})
+}
+
+func TestDeleteMissingRecordsNoRevision(t *testing.T) {
+	setupRoot(t)
+	setupRevisions(t)
+	status := DeleteFiles([]string{"missing.txt"})
+	if len(status.Errors) > 0 || status.Revision != 0 {
+		t.Errorf("deleting a missing file = %+v, want no revision", status)
+	}
+	if strings.Contains(status.Health, "deleted") {
+		t.Errorf("deleting a missing file reported %q", status.Health)
+	}
+	if ids, err := revisionIDs(); err != nil || len(ids) != 0 {
+		t.Errorf("revisions = %v, %v, want none", ids, err)
+	}
+}
+
+func TestRollbackRevision(t *testing.T) {
+	root, _ := setupRoot(t)
+	setupRevisions(t)
+	status := UploadFiles(map[string]*FileEntry{"a.txt": {Content: []byte("hello")}}, false)
+	if status.Revision == 0 {
+		t.Fatalf("upload = %+v, want a revision", status)
+	}
+	if _, err := RollbackRevision(status.Revision + 1); err != ErrUnknownRevision {
+		t.Errorf("rollback of an unknown revision = %v, want %v", err, ErrUnknownRevision)
+	}
+	if _, err := os.Stat(filepath.Join(root, "a.txt")); err != nil {
+		t.Fatalf("failed rollback changed files: %s", err)
+	}
+	if _, err := RollbackRevision(status.Revision); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "a.txt")); !os.IsNotExist(err) {
+		t.Errorf("rollback kept the uploaded file: %v", err)
+	}
+}
@@ -0,0 +1,209 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	actionRestart = "restart"
+	actionNone    = "none"
+	actionSignal  = "signal:"
+	actionHook    = "hook:"
+)
+
+// Rule maps files to the action a change of them triggers: restart,
+// signal:<SIG>, hook:<name> or none. Files are selected either by Pattern, in
+// the syntax of the ignore files and relative to the backend dir, or by Regex,
+// matched against the client path. The first matching rule applies.
+type Rule struct {
+	Pattern string `json:",omitempty"`
+	Regex   string `json:",omitempty"`
+	Action  string
+	glob    *ignoreRule
+	regex   *regexp.Regexp
+	signal  syscall.Signal
+}
+
+var rulesLock = sync.RWMutex{}
+var rules []*Rule
+
+// LoadRules reads and validates the rules from the configuration. Without
+// rules, ignore_regex and restart_regex are used instead. Hooks referenced by
+// rules have to be loaded before.
+func LoadRules() error {
+	configured := []*Rule{}
+	if err := viper.UnmarshalKey(CONFIG_RULES, &configured); err != nil {
+		return errors.New("invalid rules: " + err.Error())
+	}
+	if len(configured) == 0 {
+		configured = legacyRules()
+	}
+	for i, rule := range configured {
+		if rule == nil {
+			return fmt.Errorf("rule %d is empty", i+1)
+		}
+		if err := rule.compile(); err != nil {
+			return fmt.Errorf("rule %d: %s", i+1, err.Error())
+		}
+	}
+	rulesLock.Lock()
+	rules = configured
+	rulesLock.Unlock()
+	return nil
+}
+
+// legacyRules translates ignore_regex and restart_regex into rules.
+func legacyRules() []*Rule {
+	legacy := []*Rule{}
+	if ignoreRegex := viper.GetString(CONFIG_IGNORE_REGEX); len(ignoreRegex) > 0 {
+		legacy = append(legacy, &Rule{Regex: ignoreRegex, Action: actionNone})
+	}
+	if restartRegex := viper.GetString(CONFIG_RESTART_REGEX); len(restartRegex) > 0 {
+		legacy = append(legacy, &Rule{Regex: restartRegex, Action: actionRestart})
+	}
+	return legacy
+}
+
+func (r *Rule) compile() error {
+	if (len(r.Pattern) > 0) == (len(r.Regex) > 0) {
+		return errors.New("exactly one of pattern or regex is required")
+	}
+	if len(r.Pattern) > 0 {
+		glob, err := parseRule(r.Pattern)
+		if err != nil {
+			return err
+		}
+		if glob == nil || glob.negate {
+			return errors.New("invalid pattern " + r.Pattern)
+		}
+		r.glob = glob
+	} else {
+		regex, err := regexp.Compile(r.Regex)
+		if err != nil {
+			return errors.New("invalid regex " + r.Regex + ": " + err.Error())
+		}
+		r.regex = regex
+	}
+	switch {
+	case r.Action == actionRestart || r.Action == actionNone:
+	case strings.HasPrefix(r.Action, actionSignal):
+		name, signal, err := parseSignal(strings.TrimPrefix(r.Action, actionSignal))
+		if err != nil {
+			return err
+		}
+		r.Action = actionSignal + name
+		r.signal = signal
+	case strings.HasPrefix(r.Action, actionHook):
+		name := strings.TrimPrefix(r.Action, actionHook)
+		if !hookExists(name) {
+			return errors.New("unknown hook " + name)
+		}
+	default:
+		return errors.New("unknown action " + r.Action)
+	}
+	return nil
+}
+
+// parseSignal returns the normalized name and the signal for a name like
+// SIGHUP or hup.
+func parseSignal(name string) (string, syscall.Signal, error) {
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	signal, found := signals[name]
+	if !found {
+		return "", 0, errors.New("unsupported signal " + name)
+	}
+	return name, signal, nil
+}
+
+func (r *Rule) matches(path string, rel string) bool {
+	if r.regex != nil {
+		return r.regex.MatchString(path)
+	}
+	return r.glob.matchesPath(rel)
+}
+
+// ruleFor returns the first rule matching a client path, or nil.
+func ruleFor(path string) *Rule {
+	rulesLock.RLock()
+	loaded := rules != nil
+	rulesLock.RUnlock()
+	if !loaded {
+		if err := LoadRules(); err != nil {
+			log.Println(err)
+			rulesLock.Lock()
+			rules = []*Rule{}
+			rulesLock.Unlock()
+		}
+	}
+	_, rel, err := splitRoot(GetRoots(), path)
+	if err != nil {
+		rel = path
+	}
+	rulesLock.RLock()
+	defer rulesLock.RUnlock()
+	for _, rule := range rules {
+		if rule.matches(path, rel) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// NeedsRestart reports whether a change of the client path restarts the
+// backend.
+func NeedsRestart(path string) bool {
+	rule := ruleFor(path)
+	if rule == nil || rule.Action != actionRestart {
+		return false
+	}
+	log.Println("Requires restart for: " + path)
+	return true
+}
+
+// changePlan is what the changes of a batch trigger besides hooks.
+type changePlan struct {
+	restart bool
+	signals []*Rule
+}
+
+// planChanges evaluates the rules for the changed client paths. Each signal
+// is sent once.
+func planChanges(paths []string) changePlan {
+	plan := changePlan{}
+	sent := map[syscall.Signal]bool{}
+	for _, path := range paths {
+		rule := ruleFor(path)
+		if rule == nil {
+			continue
+		}
+		if rule.Action == actionRestart {
+			log.Println("Requires restart for: " + path)
+			plan.restart = true
+		} else if rule.signal != 0 && !sent[rule.signal] {
+			log.Println("Requires " + strings.TrimPrefix(rule.Action, actionSignal) + " for: " + path)
+			sent[rule.signal] = true
+			plan.signals = append(plan.signals, rule)
+		}
+	}
+	return plan
+}
+
+// ruleHook returns the hook a rule runs for a client path, if any.
+func ruleHook(path string) string {
+	rule := ruleFor(path)
+	if rule == nil || !strings.HasPrefix(rule.Action, actionHook) {
+		return ""
+	}
+	return strings.TrimPrefix(rule.Action, actionHook)
+}
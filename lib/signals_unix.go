@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package lib
+
+import (
+	"syscall"
+)
+
+// signals are the signals rules may send to the backend.
+var signals = map[string]syscall.Signal{
+	"SIGHUP":   syscall.SIGHUP,
+	"SIGINT":   syscall.SIGINT,
+	"SIGQUIT":  syscall.SIGQUIT,
+	"SIGTERM":  syscall.SIGTERM,
+	"SIGUSR1":  syscall.SIGUSR1,
+	"SIGUSR2":  syscall.SIGUSR2,
+	"SIGWINCH": syscall.SIGWINCH,
+	"SIGTTIN":  syscall.SIGTTIN,
+	"SIGTTOU":  syscall.SIGTTOU,
+}
@@ -0,0 +1,11 @@
+package lib
+
+import (
+	"syscall"
+)
+
+// signals are the signals rules may send to the backend. Windows processes
+// can only be killed.
+var signals = map[string]syscall.Signal{
+	"SIGKILL": syscall.SIGKILL,
+}
@@ -0,0 +1,136 @@
+package lib
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+)
+
+// UploadTar writes the regular files and symlinks of a tar stream, which may be gzipped,
+// as they arrive. The batch is committed like UploadFiles does. Optional
+// PAX_CHECKSUM and PAX_BASE_CHECKSUM records declare the SHA256 of an entry
+// and the checksum the client expects the remote file to have. With dryRun the
+// entries are only validated. An error is returned if the stream cannot be
+// read; no files are changed then.
+func UploadTar(r io.Reader, dryRun bool) (Status, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return Status{}, err
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+
+	status := Status{}
+	updated := 0
+	tx := newTransaction()
+	tx.dryRun = dryRun
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return abortStream(tx, status, err)
+		}
+		path := header.Name
+		switch header.Typeflag {
+		case tar.TypeDir:
+			continue
+		case tar.TypeReg:
+			log.Println("Updating file: " + path)
+			err = tx.Write(path, tr, &FileEntry{
+				Checksum:     header.PAXRecords[PAX_CHECKSUM],
+				Size:         header.Size,
+				Mode:         header.FileInfo().Mode().Perm(),
+				Modification: header.ModTime.Unix(),
+			})
+			if err == nil {
+				err = tx.Expect(path, header.PAXRecords[PAX_BASE_CHECKSUM])
+			}
+			updated++
+		case tar.TypeSymlink:
+			log.Println("Updating symlink: " + path)
+			err = tx.Symlink(path, header.Linkname)
+			updated++
+		default:
+			err = fmt.Errorf("unsupported tar entry type %q", header.Typeflag)
+		}
+		if err != nil {
+			log.Println(path + ": " + err.Error())
+			status.AddError(path, err)
+		}
+	}
+	return commitFiles(tx, status, updated, 0), nil
+}
+
+// UploadMultipart writes each file part of a multipart/form-data stream as it
+// arrives. The file path is taken from the part's filename, or its form name
+// if no filename is given. Optional HEADER_CHECKSUM and HEADER_BASE_CHECKSUM
+// part headers declare the SHA256 of the part and the checksum the client
+// expects the remote file to have. With dryRun the parts are only validated.
+// An error is returned if the stream cannot be read.
+func UploadMultipart(mr *multipart.Reader, dryRun bool) (Status, error) {
+	status := Status{}
+	updated := 0
+	tx := newTransaction()
+	tx.dryRun = dryRun
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return abortStream(tx, status, err)
+		}
+		path := partPath(part)
+		if len(path) == 0 {
+			part.Close()
+			continue
+		}
+		log.Println("Updating file: " + path)
+		err = tx.Write(path, part, &FileEntry{Checksum: part.Header.Get(HEADER_CHECKSUM)})
+		if err == nil {
+			err = tx.Expect(path, part.Header.Get(HEADER_BASE_CHECKSUM))
+		}
+		part.Close()
+		updated++
+		if err != nil {
+			log.Println(path + ": " + err.Error())
+			status.AddError(path, err)
+		}
+	}
+	return commitFiles(tx, status, updated, 0), nil
+}
+
+// partPath returns the unmodified filename of a part. multipart.Part.FileName
+// strips directories, which are significant here.
+func partPath(part *multipart.Part) string {
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err == nil && len(params["filename"]) > 0 {
+		return params["filename"]
+	}
+	return part.FormName()
+}
+
+// abortStream discards a stream that could not be read. A quota exceeded while
+// reading an entry is returned instead of err, as it is what cut the stream off
+// and the reader may not report it again.
+func abortStream(tx *transaction, status Status, err error) (Status, error) {
+	log.Println(err)
+	tx.Abort()
+	if _, ok := err.(*QuotaError); !ok && status.Quota != nil {
+		err = status.Quota
+	}
+	return Status{}, err
+}
@@ -0,0 +1,79 @@
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"mime/multipart"
+	"strings"
+	"testing"
+)
+
+func tarball(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, content := range files {
+		header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestUploadTarUnreadable(t *testing.T) {
+	setupRoot(t)
+	valid := tarball(t, map[string]string{"a.txt": strings.Repeat("a", 2048)})
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(valid)
+	zw.Close()
+	corrupt := append([]byte{}, gz.Bytes()...)
+	corrupt[len(corrupt)/2] ^= 0xff
+	tests := []struct {
+		name string
+		body []byte
+		err  bool
+	}{
+		{name: "tar", body: valid},
+		{name: "gzipped tar", body: gz.Bytes()},
+		{name: "truncated tar", body: valid[:1024], err: true},
+		{name: "corrupt gzip", body: corrupt, err: true},
+		{name: "gzip header only", body: gz.Bytes()[:4], err: true},
+	}
+	for _, test := range tests {
+		_, err := UploadTar(bytes.NewReader(test.body), true)
+		if test.err && err == nil {
+			t.Errorf("%s: upload succeeded, want error", test.name)
+		}
+		if !test.err && err != nil {
+			t.Errorf("%s: upload failed: %s", test.name, err)
+		}
+	}
+}
+
+func TestUploadMultipartUnreadable(t *testing.T) {
+	setupRoot(t)
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	part, err := mw.CreateFormFile("file", "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte("hello"))
+	mw.Close()
+	body := buf.Bytes()
+	if _, err := UploadMultipart(multipart.NewReader(bytes.NewReader(body), mw.Boundary()), true); err != nil {
+		t.Errorf("upload failed: %s", err)
+	}
+	truncated := body[:len(body)-len(mw.Boundary())-8]
+	if _, err := UploadMultipart(multipart.NewReader(bytes.NewReader(truncated), mw.Boundary()), true); err == nil {
+		t.Errorf("truncated upload succeeded, want error")
+	}
+}
@@ -0,0 +1,345 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/xiwenc/cf-fastpush-controller/utils"
+)
+
+const stagingPrefix = ".fastpush-"
+
+// fileOp is a single staged change of a transaction.
+type fileOp struct {
+	path      string
+	temp      string
+	backup    string
+	size      int64
+	checksum  string
+	target    string
+	delete    bool
+	existed   bool
+	committed bool
+}
+
+// transaction stages writes and deletes next to their targets and applies
+// them all at once on commit. A failed commit restores the previous state.
+// A dry run only validates the changes without touching the disk.
+type transaction struct {
+	ops       []*fileOp
+	newDirs   []string
+	expected  map[string]string
+	revision  int
+	committed bool
+	dryRun    bool
+}
+
+// commitLock serializes commits so conflict checks see a stable tree.
+var commitLock = sync.Mutex{}
+
+func newTransaction() *transaction {
+	return &transaction{}
+}
+
+// Write stages the content read from r for path in a temporary file in the
+// target directory. The Checksum, Mode and Modification of entry are applied
+// when set; a Checksum must match the SHA256 of the content. Without a Mode an
+// existing file keeps its mode. A Size is checked against the quotas before
+// anything is written.
+func (t *transaction) Write(path string, r io.Reader, entry *FileEntry) error {
+	resolved, err := ResolvePath(path)
+	if err != nil {
+		return err
+	}
+	if IsIgnored(resolved, false) {
+		return ErrIgnored
+	}
+	if len(entry.Checksum) > 0 && checksumAlgorithmOf(entry.Checksum) != utils.SHA256 {
+		return ErrChecksumAlgorithm
+	}
+	if err := t.checkBatchQuota(); err != nil {
+		return err
+	}
+	dir := filepath.Dir(resolved)
+	if !t.dryRun {
+		if err := t.mkdirAll(dir); err != nil {
+			return err
+		}
+	}
+	if err := checkFileQuota(dir, entry.Size); err != nil {
+		return err
+	}
+	op := &fileOp{path: resolved}
+	t.ops = append(t.ops, op)
+	sum := utils.NewChecksumWriter(utils.SHA256)
+	if t.dryRun {
+		op.size, err = io.Copy(sum, limitFile(r))
+	} else {
+		op.size, err = stage(op, dir, io.TeeReader(limitFile(r), sum))
+	}
+	if err != nil {
+		return err
+	}
+	op.checksum = sum.Sum().SHA256
+	if len(entry.Checksum) > 0 && op.checksum != entry.Checksum {
+		return fmt.Errorf("checksum mismatch: expected %s, got %s", entry.Checksum, op.checksum)
+	}
+	if t.dryRun {
+		return nil
+	}
+	mode := entry.Mode.Perm()
+	if mode == 0 {
+		mode = 0644
+		if info, err := os.Stat(resolved); err == nil && info.Mode().IsRegular() {
+			// keep the mode, e.g. the executable bit, of the file being replaced
+			mode = info.Mode().Perm()
+		}
+	}
+	if err := os.Chmod(op.temp, mode); err != nil {
+		return err
+	}
+	if entry.Modification > 0 {
+		mtime := time.Unix(entry.Modification, 0)
+		return os.Chtimes(op.temp, mtime, mtime)
+	}
+	return nil
+}
+
+// stage copies r into a new temporary file in dir for op.
+func stage(op *fileOp, dir string, r io.Reader) (int64, error) {
+	temp, err := ioutil.TempFile(dir, stagingPrefix)
+	if err != nil {
+		return 0, err
+	}
+	op.temp = temp.Name()
+	size, err := io.Copy(temp, r)
+	if cerr := temp.Close(); err == nil {
+		err = cerr
+	}
+	return size, err
+}
+
+// Symlink stages a symlink at path pointing to target. The target has to
+// resolve within the backend dirs as well.
+func (t *transaction) Symlink(path string, target string) error {
+	resolved, err := ResolveParentPath(path)
+	if err != nil {
+		return err
+	}
+	if IsIgnored(resolved, false) {
+		return ErrIgnored
+	}
+	absTarget := target
+	if !filepath.IsAbs(target) {
+		absTarget = filepath.Join(filepath.Dir(resolved), target)
+	}
+	if err := confineAny(absTarget); err != nil {
+		return fmt.Errorf("symlink target %s: %s", target, err.Error())
+	}
+	if err := t.checkBatchQuota(); err != nil {
+		return err
+	}
+	op := &fileOp{path: resolved, target: target}
+	if t.dryRun {
+		t.ops = append(t.ops, op)
+		return nil
+	}
+	dir := filepath.Dir(resolved)
+	if err := t.mkdirAll(dir); err != nil {
+		return err
+	}
+	temp, err := backupName(resolved)
+	if err != nil {
+		return err
+	}
+	os.Remove(temp)
+	t.ops = append(t.ops, op)
+	if err := os.Symlink(target, temp); err != nil {
+		return err
+	}
+	op.temp = temp
+	return nil
+}
+
+// Delete stages the removal of path.
+func (t *transaction) Delete(path string) error {
+	resolved, err := ResolveParentPath(path)
+	if err != nil {
+		return err
+	}
+	if IsIgnored(resolved, false) {
+		return ErrIgnored
+	}
+	if err := t.checkBatchQuota(); err != nil {
+		return err
+	}
+	t.ops = append(t.ops, &fileOp{path: resolved, delete: true})
+	return nil
+}
+
+// Commit moves all staged files into place unless a file changed since the
+// client listed it or the backend dirs would exceed max_total_size. Existing
+// targets are kept aside until every operation succeeded so they can be
+// restored on failure. A dry run stops after the checks.
+func (t *transaction) Commit() error {
+	commitLock.Lock()
+	defer commitLock.Unlock()
+	if err := t.checkConflicts(); err != nil {
+		t.Abort()
+		return err
+	}
+	if err := t.checkTotalQuota(); err != nil {
+		t.Abort()
+		return err
+	}
+	if t.dryRun {
+		return nil
+	}
+	for _, op := range t.ops {
+		if err := t.commitOp(op); err != nil {
+			log.Println("Commit failed, rolling back: " + err.Error())
+			t.rollback()
+			return err
+		}
+	}
+	t.committed = true
+	// a batch that only deleted missing files changed nothing to revert
+	if revisionsEnabled() && t.missingDeletes() < len(t.ops) {
+		id, err := recordRevision(t.ops)
+		if err != nil {
+			log.Println("Unable to record revision: " + err.Error())
+		}
+		t.revision = id
+	}
+	for _, op := range t.ops {
+		if len(op.backup) > 0 {
+			os.Remove(op.backup)
+		}
+		reloadIgnoreRulesFor(op.path)
+		if op.delete {
+			storeLock.Lock()
+			delete(store, op.path)
+			storeLock.Unlock()
+		} else if info, err := os.Lstat(op.path); err == nil {
+			// the watcher may report the write after the response went out
+			indexFile(op.path, info, true)
+		}
+	}
+	return nil
+}
+
+// missingDeletes counts the committed deletes of files that did not exist.
+func (t *transaction) missingDeletes() int {
+	missing := 0
+	for _, op := range t.ops {
+		if op.delete && op.committed && !op.existed {
+			missing++
+		}
+	}
+	return missing
+}
+
+// clientPaths returns the client paths of the staged changes.
+func (t *transaction) clientPaths() []string {
+	roots := GetRoots()
+	paths := []string{}
+	for _, op := range t.ops {
+		paths = append(paths, clientPath(roots, op.path))
+	}
+	return paths
+}
+
+// Abort discards all staged files without touching the targets.
+func (t *transaction) Abort() {
+	for _, op := range t.ops {
+		if len(op.temp) > 0 {
+			os.Remove(op.temp)
+		}
+	}
+	t.removeNewDirs()
+}
+
+func (t *transaction) commitOp(op *fileOp) error {
+	markOwnChange(op.path)
+	if _, err := os.Lstat(op.path); err == nil {
+		op.existed = true
+		backup, err := backupName(op.path)
+		if err != nil {
+			return err
+		}
+		if err := os.Rename(op.path, backup); err != nil {
+			os.Remove(backup)
+			return err
+		}
+		op.backup = backup
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	op.committed = true
+	if op.delete {
+		return nil
+	}
+	if err := os.Rename(op.temp, op.path); err != nil {
+		return err
+	}
+	op.temp = ""
+	return nil
+}
+
+func (t *transaction) rollback() {
+	for i := len(t.ops) - 1; i >= 0; i-- {
+		op := t.ops[i]
+		if op.committed {
+			if len(op.temp) == 0 && !op.delete {
+				os.Remove(op.path)
+			}
+			if len(op.backup) > 0 {
+				if err := os.Rename(op.backup, op.path); err != nil {
+					log.Println("Unable to restore " + op.path + ": " + err.Error())
+				}
+			}
+		}
+	}
+	t.Abort()
+}
+
+func (t *transaction) mkdirAll(dir string) error {
+	missing := []string{}
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Lstat(d); err == nil || filepath.Dir(d) == d {
+			break
+		}
+		missing = append(missing, d)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		t.newDirs = append(t.newDirs, missing[i])
+	}
+	return nil
+}
+
+func (t *transaction) removeNewDirs() {
+	// parents were appended before their children
+	for i := len(t.newDirs) - 1; i >= 0; i-- {
+		os.Remove(t.newDirs[i])
+	}
+	t.newDirs = nil
+}
+
+// backupName reserves a unique name next to path to keep its old content.
+func backupName(path string) (string, error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), stagingPrefix)
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	return f.Name(), nil
+}
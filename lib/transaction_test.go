@@ -0,0 +1,97 @@
+package lib
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func storedEntry(path string) *FileEntry {
+	storeLock.RLock()
+	defer storeLock.RUnlock()
+	return store[path]
+}
+
+func TestCommitIndexesFiles(t *testing.T) {
+	setupRoot(t)
+	tx := newTransaction()
+	if err := tx.Write("a.txt", strings.NewReader("hello"), &FileEntry{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	resolved, err := ResolvePath("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := storedEntry(resolved)
+	if entry == nil || entry.Size != 5 {
+		t.Fatalf("store entry of %s = %+v, want the committed file", resolved, entry)
+	}
+	// a late watcher event for the target moved aside must not drop it
+	fileRemoved(resolved)
+	if storedEntry(resolved) == nil {
+		t.Errorf("store entry of %s was dropped for an existing file", resolved)
+	}
+}
+
+func TestWriteKeepsMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permissions are not supported on windows")
+	}
+	root, _ := setupRoot(t)
+	if err := ioutil.WriteFile(filepath.Join(root, "start.sh"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		mode os.FileMode
+		want os.FileMode
+	}{
+		{path: "start.sh", want: 0755},
+		{path: "start.sh", mode: 0600, want: 0600},
+		{path: "new.txt", want: 0644},
+		{path: "new.sh", mode: 0750, want: 0750},
+	}
+	for _, test := range tests {
+		tx := newTransaction()
+		if err := tx.Write(test.path, strings.NewReader("exec app\n"), &FileEntry{Mode: test.mode}); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(filepath.Join(root, test.path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := info.Mode().Perm(); mode != test.want {
+			t.Errorf("writing %s with mode %o left mode %o, want %o", test.path, test.mode, mode, test.want)
+		}
+	}
+}
+
+func TestUploadFilesChecksContentSize(t *testing.T) {
+	root, _ := setupRoot(t)
+	free, err := freeSpace(root)
+	if err != nil || free <= 0 {
+		t.Skip("free space is unknown")
+	}
+	// leave room for 2 MiB but upload 4 MiB with a smaller declared Size
+	viper.Set(CONFIG_MIN_FREE_SPACE, free-2*1024*1024)
+	defer viper.Set(CONFIG_MIN_FREE_SPACE, 0)
+	content := bytes.Repeat([]byte("a"), 4*1024*1024)
+	for _, size := range []int64{0, 1} {
+		status := UploadFiles(map[string]*FileEntry{"a.txt": {Content: content, Size: size}}, true)
+		if status.Quota == nil || status.Quota.Limit != CONFIG_MIN_FREE_SPACE {
+			t.Errorf("upload with Size %d = %+v, want min_free_space exceeded", size, status)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package lib
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/xiwenc/cf-fastpush-controller/utils"
+)
+
+const sessionFile = "session.json"
+
+// uploadExpiry is how long an unfinished upload session is kept.
+const uploadExpiry = 24 * time.Hour
+
+var ErrUnknownUpload = errors.New("unknown upload session")
+
+var sessionIDPattern = regexp.MustCompile("^[0-9a-f]{32}$")
+var sessionLock = sync.Mutex{}
+
+// UploadSession is a single file uploaded in numbered chunks. Chunks lists the
+// chunks received so far, an interrupted upload resumes with the first chunk
+// missing from it.
+type UploadSession struct {
+	ID           string
+	Path         string
+	Checksum     string
+	BaseChecksum string `json:",omitempty"`
+	Mode         os.FileMode
+	Modification int64
+	Created      int64
+	Chunks       []int
+}
+
+// CreateUploadSession starts a chunked upload of session.Path. The Checksum
+// of the whole file is required and verified when the upload is finalized.
+func CreateUploadSession(session UploadSession) (UploadSession, error) {
+	if len(session.Checksum) == 0 {
+		return UploadSession{}, errors.New("missing checksum")
+	}
+	if checksumAlgorithmOf(session.Checksum) != utils.SHA256 {
+		return UploadSession{}, ErrChecksumAlgorithm
+	}
+	resolved, err := ResolvePath(session.Path)
+	if err != nil {
+		return UploadSession{}, err
+	}
+	if IsIgnored(resolved, false) {
+		return UploadSession{}, ErrIgnored
+	}
+	pruneUploadSessions()
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return UploadSession{}, err
+	}
+	session.ID = hex.EncodeToString(id)
+	session.Created = time.Now().Unix()
+	session.Chunks = []int{}
+	if err := os.MkdirAll(sessionDir(session.ID), 0755); err != nil {
+		return UploadSession{}, err
+	}
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+	if err := saveUploadSession(session); err != nil {
+		return UploadSession{}, err
+	}
+	log.Println("Started upload " + session.ID + " of " + session.Path)
+	return session, nil
+}
+
+// GetUploadSession returns the state of an upload session.
+func GetUploadSession(id string) (UploadSession, error) {
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+	return loadUploadSession(id)
+}
+
+// UploadChunk stores chunk number n of an upload session. A chunk is only
+// acknowledged once it is completely written and, if checksum is not empty,
+// matches its SHA256. Sending a chunk again replaces it.
+func UploadChunk(id string, n int, r io.Reader, checksum string) (UploadSession, error) {
+	if n < 0 {
+		return UploadSession{}, errors.New("invalid chunk number " + strconv.Itoa(n))
+	}
+	if _, err := GetUploadSession(id); err != nil {
+		return UploadSession{}, err
+	}
+	dir := sessionDir(id)
+	if err := checkFileQuota(dir, 0); err != nil {
+		return UploadSession{}, err
+	}
+	temp, err := ioutil.TempFile(dir, stagingPrefix)
+	if err != nil {
+		return UploadSession{}, err
+	}
+	defer os.Remove(temp.Name())
+	sum := utils.NewChecksumWriter(utils.SHA256)
+	_, err = io.Copy(temp, io.TeeReader(r, sum))
+	if cerr := temp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return UploadSession{}, err
+	}
+	if actual := sum.Sum().SHA256; len(checksum) > 0 && actual != checksum {
+		return UploadSession{}, fmt.Errorf("checksum mismatch: expected %s, got %s", checksum, actual)
+	}
+
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+	session, err := loadUploadSession(id)
+	if err != nil {
+		return UploadSession{}, err
+	}
+	if err := os.Rename(temp.Name(), filepath.Join(dir, strconv.Itoa(n))); err != nil {
+		return UploadSession{}, err
+	}
+	found := false
+	for _, chunk := range session.Chunks {
+		found = found || chunk == n
+	}
+	if !found {
+		session.Chunks = append(session.Chunks, n)
+		sort.Ints(session.Chunks)
+	}
+	return session, saveUploadSession(session)
+}
+
+// FinalizeUpload joins the chunks of an upload session and commits the file
+// like UploadFiles does. The chunks have to be numbered without gaps starting
+// at 0. The session is removed once the file is committed. An error is only
+// returned if the session cannot be loaded.
+func FinalizeUpload(id string) (Status, error) {
+	session, err := GetUploadSession(id)
+	if err != nil {
+		return Status{}, err
+	}
+	status := Status{}
+	readers := []io.Reader{}
+	size := int64(0)
+	for i, chunk := range session.Chunks {
+		if chunk != i {
+			status.AddError(session.Path, errors.New("missing chunk "+strconv.Itoa(i)))
+			break
+		}
+		file, err := os.Open(filepath.Join(sessionDir(id), strconv.Itoa(chunk)))
+		if err != nil {
+			status.AddError(session.Path, err)
+			break
+		}
+		defer file.Close()
+		if info, err := file.Stat(); err == nil {
+			size += info.Size()
+		}
+		readers = append(readers, file)
+	}
+
+	tx := newTransaction()
+	if len(status.Errors) == 0 {
+		log.Println("Updating file: " + session.Path)
+		err := tx.Write(session.Path, io.MultiReader(readers...), &FileEntry{
+			Checksum:     session.Checksum,
+			Size:         size,
+			Mode:         session.Mode,
+			Modification: session.Modification,
+		})
+		if err == nil {
+			err = tx.Expect(session.Path, session.BaseChecksum)
+		}
+		if err != nil {
+			log.Println(session.Path + ": " + err.Error())
+			status.AddError(session.Path, err)
+		}
+	}
+	status = commitFiles(tx, status, 1, 0)
+	if tx.committed {
+		AbortUpload(id)
+	}
+	return status, nil
+}
+
+// AbortUpload removes an upload session and its chunks.
+func AbortUpload(id string) error {
+	if !sessionIDPattern.MatchString(id) {
+		return ErrUnknownUpload
+	}
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+	return os.RemoveAll(sessionDir(id))
+}
+
+func sessionDir(id string) string {
+	return filepath.Join(viper.GetString(CONFIG_UPLOAD_DIR), id)
+}
+
+// loadUploadSession reads a session. It must be called while holding
+// sessionLock.
+func loadUploadSession(id string) (UploadSession, error) {
+	if !sessionIDPattern.MatchString(id) {
+		return UploadSession{}, ErrUnknownUpload
+	}
+	data, err := ioutil.ReadFile(filepath.Join(sessionDir(id), sessionFile))
+	if os.IsNotExist(err) {
+		return UploadSession{}, ErrUnknownUpload
+	}
+	if err != nil {
+		return UploadSession{}, err
+	}
+	session := UploadSession{}
+	err = json.Unmarshal(data, &session)
+	return session, err
+}
+
+// saveUploadSession writes a session. It must be called while holding
+// sessionLock.
+func saveUploadSession(session UploadSession) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	dir := sessionDir(session.ID)
+	temp, err := ioutil.TempFile(dir, stagingPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	_, err = temp.Write(data)
+	if cerr := temp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), filepath.Join(dir, sessionFile))
+}
+
+// pruneUploadSessions removes sessions that were not finalized in time.
+func pruneUploadSessions() {
+	entries, err := ioutil.ReadDir(viper.GetString(CONFIG_UPLOAD_DIR))
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if sessionIDPattern.MatchString(entry.Name()) && time.Since(entry.ModTime()) > uploadExpiry {
+			log.Println("Removing expired upload " + entry.Name())
+			AbortUpload(entry.Name())
+		}
+	}
+}
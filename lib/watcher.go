@@ -0,0 +1,148 @@
+package lib
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// ownChangeWindow is how long watcher events for a path committed by the
+// controller itself are not treated as external changes.
+const ownChangeWindow = 2 * time.Second
+
+// externalRestartDelay collects the events of a single external change, like
+// an editor saving a file, into one restart.
+const externalRestartDelay = 500 * time.Millisecond
+
+var watching = false
+var watchLock = sync.Mutex{}
+var ownChanges = map[string]time.Time{}
+var hooksRunning = 0
+var hooksFinished time.Time
+
+// IsWatching reports whether the watcher keeps the store current.
+func IsWatching() bool {
+	watchLock.Lock()
+	defer watchLock.Unlock()
+	return watching
+}
+
+func setWatching(active bool) {
+	watchLock.Lock()
+	watching = active
+	watchLock.Unlock()
+}
+
+// WatchFiles builds the index of the backend dirs and, if enabled, keeps it
+// current with a filesystem watcher. It blocks while watching.
+func WatchFiles() {
+	LoadCache()
+	if !viper.GetBool(CONFIG_WATCH_FILES) {
+		ListFiles()
+		return
+	}
+	if err := watchDirs(GetRootDirs()); err != nil {
+		log.Println("Unable to watch files, listing on demand: " + err.Error())
+		setWatching(false)
+		ListFiles()
+	}
+}
+
+func markOwnChange(path string) {
+	watchLock.Lock()
+	ownChanges[path] = time.Now()
+	watchLock.Unlock()
+}
+
+func isOwnChange(path string) bool {
+	watchLock.Lock()
+	defer watchLock.Unlock()
+	for changed, at := range ownChanges {
+		if time.Since(at) > ownChangeWindow {
+			delete(ownChanges, changed)
+		}
+	}
+	_, found := ownChanges[path]
+	return found
+}
+
+// markHooksRunning tracks running hooks. Files written by hooks, like build
+// output, are not treated as external changes.
+func markHooksRunning(running bool) {
+	watchLock.Lock()
+	defer watchLock.Unlock()
+	if running {
+		hooksRunning++
+	} else {
+		hooksRunning--
+		hooksFinished = time.Now()
+	}
+}
+
+func isHookChange() bool {
+	watchLock.Lock()
+	defer watchLock.Unlock()
+	return hooksRunning > 0 || time.Since(hooksFinished) < ownChangeWindow
+}
+
+// fileChanged re-indexes path after the watcher saw it change. It returns the
+// info of path, or nil if it is gone.
+func fileChanged(path string) os.FileInfo {
+	reloadIgnoreRulesFor(path)
+	info, err := os.Lstat(path)
+	if err != nil {
+		fileRemoved(path)
+		return nil
+	}
+	if IsIgnored(path, info.IsDir()) {
+		return nil
+	}
+	if info.IsDir() {
+		indexDir(path, nil)
+	} else {
+		indexFile(path, info, true)
+	}
+	externalChange(path)
+	return info
+}
+
+// fileRemoved drops path, and everything below it, from the store. A file
+// that exists again, like the target of a commit moved aside before, is kept.
+func fileRemoved(path string) {
+	reloadIgnoreRulesFor(path)
+	if IsIgnored(path, false) {
+		return
+	}
+	if info, err := os.Lstat(path); err == nil && !info.IsDir() {
+		return
+	}
+	prefix := path + string(filepath.Separator)
+	storeLock.Lock()
+	for stored := range store {
+		if stored == path || strings.HasPrefix(stored, prefix) {
+			delete(store, stored)
+		}
+	}
+	storeLock.Unlock()
+	scheduleCacheSave()
+	externalChange(path)
+}
+
+// externalChange restarts or reloads the backend if a change not made through the
+// controller requires it.
+func externalChange(path string) {
+	if isOwnChange(path) || isHookChange() || !NeedsRestart(ClientPath(path)) {
+		return
+	}
+	log.Println("External change of " + path)
+	delay := restartQuietPeriod()
+	if delay < externalRestartDelay {
+		delay = externalRestartDelay
+	}
+	scheduleRestart(delay)
+}
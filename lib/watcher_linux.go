@@ -0,0 +1,105 @@
+package lib
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const watchMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE
+
+// inotifyWatcher maps inotify watch descriptors to the watched directories.
+type inotifyWatcher struct {
+	fd   int
+	dirs map[int32]string
+}
+
+func watchDirs(roots []string) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	w := &inotifyWatcher{fd: fd, dirs: map[int32]string{}}
+	for _, root := range roots {
+		if err := w.addRecursive(root); err != nil {
+			return err
+		}
+	}
+	log.Println("Watching files for: " + strings.Join(roots, " "))
+	reindex(roots)
+	setWatching(true)
+	return w.run(roots)
+}
+
+// addRecursive watches dir and all directories below it.
+func (w *inotifyWatcher) addRecursive(dir string) error {
+	return filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+		if err != nil || !f.IsDir() {
+			return nil
+		}
+		if path != dir && IsIgnored(path, true) {
+			return filepath.SkipDir
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, path, watchMask)
+		if err != nil {
+			return err
+		}
+		w.dirs[int32(wd)] = path
+		return nil
+	})
+}
+
+func (w *inotifyWatcher) run(roots []string) error {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := syscall.Read(w.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[nameStart:nameStart+int(event.Len)]), "\x00")
+			offset = nameStart + int(event.Len)
+			w.handle(event, name, roots)
+		}
+	}
+}
+
+func (w *inotifyWatcher) handle(event *syscall.InotifyEvent, name string, roots []string) {
+	if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+		log.Println("Watcher queue overflowed, re-indexing")
+		for _, root := range roots {
+			w.addRecursive(root)
+		}
+		reindex(roots)
+		return
+	}
+	dir, found := w.dirs[event.Wd]
+	if event.Mask&syscall.IN_IGNORED != 0 {
+		delete(w.dirs, event.Wd)
+		return
+	}
+	if !found || len(name) == 0 {
+		return
+	}
+	path := filepath.Join(dir, name)
+	if event.Mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0 {
+		fileRemoved(path)
+		return
+	}
+	if event.Mask&syscall.IN_ISDIR != 0 && event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+		if err := w.addRecursive(path); err != nil {
+			log.Println(err)
+		}
+	}
+	fileChanged(path)
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package lib
+
+import (
+	"errors"
+)
+
+func watchDirs(roots []string) error {
+	return errors.New("file watching is only supported on linux")
+}
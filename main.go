@@ -1,15 +1,20 @@
 package main
 
 import (
+	"bufio"
 	"log"
 	"net/url"
 	"net/http"
 	"net/http/httputil"
 	"encoding/json"
+	"io/ioutil"
+	"mime"
 
 	"github.com/spf13/viper"
 	"github.com/xiwenc/cf-fastpush-controller/lib"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 )
 
@@ -37,6 +42,24 @@ func main() {
 	viper.SetDefault(lib.CONFIG_BACKEND_COMMAND, "python -m http.server")
 	viper.SetDefault(lib.CONFIG_BACKEND_PORT, "8080")
 	viper.SetDefault(lib.CONFIG_BASE_PATH, "/_fastpush")
+	viper.SetDefault(lib.CONFIG_DELTA_BLOCK_SIZE, 8192)
+	viper.SetDefault(lib.CONFIG_BLOB_DIR, filepath.Join(os.TempDir(), "fastpush-blobs"))
+	viper.SetDefault(lib.CONFIG_WATCH_FILES, true)
+	viper.SetDefault(lib.CONFIG_CACHE_FILE, filepath.Join(os.TempDir(), "fastpush-cache.json"))
+	viper.SetDefault(lib.CONFIG_CHECKSUM_ALGORITHM, "sha256")
+	viper.SetDefault(lib.CONFIG_HASH_WORKERS, 0)
+	viper.SetDefault(lib.CONFIG_IGNORE_FILES, ".cfignore")
+	viper.SetDefault(lib.CONFIG_IGNORE_PATTERNS, "")
+	viper.SetDefault(lib.CONFIG_REVISION_DIR, filepath.Join(os.TempDir(), "fastpush-revisions"))
+	viper.SetDefault(lib.CONFIG_REVISION_LIMIT, 10)
+	viper.SetDefault(lib.CONFIG_UPLOAD_DIR, filepath.Join(os.TempDir(), "fastpush-uploads"))
+	viper.SetDefault(lib.CONFIG_MAX_REQUEST_SIZE, 0)
+	viper.SetDefault(lib.CONFIG_MAX_FILE_SIZE, 0)
+	viper.SetDefault(lib.CONFIG_MAX_BATCH_FILES, 0)
+	viper.SetDefault(lib.CONFIG_MAX_TOTAL_SIZE, 0)
+	viper.SetDefault(lib.CONFIG_MIN_FREE_SPACE, 0)
+	viper.SetDefault(lib.CONFIG_RELOAD_SIGNAL, "")
+	viper.SetDefault(lib.CONFIG_RESTART_QUIET_PERIOD, 0)
 
 	appCmd = viper.GetString(lib.CONFIG_BACKEND_COMMAND)
 	listenOn = viper.GetString(lib.CONFIG_BIND_ADDRESS) + ":" + viper.GetString(lib.CONFIG_PORT)
@@ -44,6 +67,22 @@ func main() {
 	basePath := viper.GetString(lib.CONFIG_BASE_PATH)
 	localAuthToken := GetLocalToken();
 
+	if err := lib.ValidateRoots(); err != nil {
+		log.Fatalln(err)
+	}
+	if err := lib.ValidateChecksumAlgorithm(); err != nil {
+		log.Fatalln(err)
+	}
+	if err := lib.LoadHooks(); err != nil {
+		log.Fatalln(err)
+	}
+	if err := lib.LoadRules(); err != nil {
+		log.Fatalln(err)
+	}
+	if err := lib.ValidateReloadSignal(); err != nil {
+		log.Fatalln(err)
+	}
+
 	log.Println("Controller listening to: " + listenOn)
 
 	http.HandleFunc(basePath + "/files", func(w http.ResponseWriter, r *http.Request) {
@@ -56,6 +95,23 @@ func main() {
 			ListFiles(w, r)
 		} else if r.Method == "PUT" {
 			UploadFiles(w, r)
+		} else if r.Method == "DELETE" {
+			DeleteFiles(w, r)
+		} else {
+			http.Error(w, "Invalid request method.", http.StatusMethodNotAllowed)
+		}
+	})
+	http.HandleFunc(basePath + "/files/", func(w http.ResponseWriter, r *http.Request) {
+		if !IsAuthenticated(r, localAuthToken) {
+			http.Error(w, "Invalid authentication token", http.StatusUnauthorized)
+			return
+		}
+		path := strings.TrimPrefix(r.URL.Path, basePath + "/files/")
+		if path == "diff" && r.Method == "POST" {
+			SetJsonContentType(w)
+			DiffFiles(w, r)
+		} else if r.Method == "GET" || r.Method == "HEAD" {
+			DownloadFile(w, r, path)
 		} else {
 			http.Error(w, "Invalid request method.", http.StatusMethodNotAllowed)
 		}
@@ -84,6 +140,117 @@ func main() {
 			http.Error(w, "Invalid request method.", http.StatusMethodNotAllowed)
 		}
 	})
+	http.HandleFunc(basePath + "/signatures", func(w http.ResponseWriter, r *http.Request) {
+		SetJsonContentType(w)
+		if !IsAuthenticated(r, localAuthToken) {
+			http.Error(w, "Invalid authentication token", http.StatusUnauthorized)
+			return
+		}
+		if r.Method == "GET" {
+			GetSignature(w, r)
+		} else {
+			http.Error(w, "Invalid request method.", http.StatusMethodNotAllowed)
+		}
+	})
+	http.HandleFunc(basePath + "/delta", func(w http.ResponseWriter, r *http.Request) {
+		SetJsonContentType(w)
+		if !IsAuthenticated(r, localAuthToken) {
+			http.Error(w, "Invalid authentication token", http.StatusUnauthorized)
+			return
+		}
+		if r.Method == "PUT" {
+			ApplyDeltas(w, r)
+		} else {
+			http.Error(w, "Invalid request method.", http.StatusMethodNotAllowed)
+		}
+	})
+	http.HandleFunc(basePath + "/blobs/", func(w http.ResponseWriter, r *http.Request) {
+		SetJsonContentType(w)
+		if !IsAuthenticated(r, localAuthToken) {
+			http.Error(w, "Invalid authentication token", http.StatusUnauthorized)
+			return
+		}
+		sum := strings.TrimPrefix(r.URL.Path, basePath + "/blobs/")
+		if sum == "missing" && r.Method == "POST" {
+			MissingBlobs(w, r)
+		} else if r.Method == "PUT" {
+			StoreBlob(w, r, sum)
+		} else if r.Method == "HEAD" {
+			HasBlob(w, r, sum)
+		} else {
+			http.Error(w, "Invalid request method.", http.StatusMethodNotAllowed)
+		}
+	})
+	http.HandleFunc(basePath + "/manifest", func(w http.ResponseWriter, r *http.Request) {
+		SetJsonContentType(w)
+		if !IsAuthenticated(r, localAuthToken) {
+			http.Error(w, "Invalid authentication token", http.StatusUnauthorized)
+			return
+		}
+		if r.Method == "POST" {
+			CommitManifest(w, r)
+		} else {
+			http.Error(w, "Invalid request method.", http.StatusMethodNotAllowed)
+		}
+	})
+	http.HandleFunc(basePath + "/revisions", func(w http.ResponseWriter, r *http.Request) {
+		SetJsonContentType(w)
+		if !IsAuthenticated(r, localAuthToken) {
+			http.Error(w, "Invalid authentication token", http.StatusUnauthorized)
+			return
+		}
+		if r.Method == "GET" {
+			ListRevisions(w, r)
+		} else {
+			http.Error(w, "Invalid request method.", http.StatusMethodNotAllowed)
+		}
+	})
+	http.HandleFunc(basePath + "/revisions/", func(w http.ResponseWriter, r *http.Request) {
+		SetJsonContentType(w)
+		if !IsAuthenticated(r, localAuthToken) {
+			http.Error(w, "Invalid authentication token", http.StatusUnauthorized)
+			return
+		}
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, basePath + "/revisions/"), "/")
+		if len(parts) != 2 || parts[1] != "rollback" {
+			http.NotFound(w, r)
+		} else if r.Method == "POST" {
+			RollbackRevision(w, r, parts[0])
+		} else {
+			http.Error(w, "Invalid request method.", http.StatusMethodNotAllowed)
+		}
+	})
+	http.HandleFunc(basePath + "/uploads", func(w http.ResponseWriter, r *http.Request) {
+		SetJsonContentType(w)
+		if !IsAuthenticated(r, localAuthToken) {
+			http.Error(w, "Invalid authentication token", http.StatusUnauthorized)
+			return
+		}
+		if r.Method == "POST" {
+			CreateUpload(w, r)
+		} else {
+			http.Error(w, "Invalid request method.", http.StatusMethodNotAllowed)
+		}
+	})
+	http.HandleFunc(basePath + "/uploads/", func(w http.ResponseWriter, r *http.Request) {
+		SetJsonContentType(w)
+		if !IsAuthenticated(r, localAuthToken) {
+			http.Error(w, "Invalid authentication token", http.StatusUnauthorized)
+			return
+		}
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, basePath + "/uploads/"), "/")
+		if len(parts) == 1 && r.Method == "GET" {
+			GetUpload(w, r, parts[0])
+		} else if len(parts) == 1 && r.Method == "DELETE" {
+			AbortUpload(w, r, parts[0])
+		} else if len(parts) == 3 && parts[1] == "chunks" && r.Method == "PUT" {
+			UploadChunk(w, r, parts[0], parts[2])
+		} else if len(parts) == 2 && parts[1] == "finalize" && r.Method == "POST" {
+			FinalizeUpload(w, r, parts[0])
+		} else {
+			http.Error(w, "Invalid request method.", http.StatusMethodNotAllowed)
+		}
+	})
 	reverseProxy := httputil.NewSingleHostReverseProxy(&url.URL{
 		Scheme: "http",
 		Host:   backendOn,
@@ -91,7 +258,7 @@ func main() {
 	http.HandleFunc("/", ReverseProxyHandler(reverseProxy))
 
 	go lib.RestartApp(appCmd)
-	go lib.ListFiles()
+	go lib.WatchFiles()
 	http.ListenAndServe(listenOn, nil)
 }
 
@@ -130,6 +297,30 @@ func GetLocalToken() string {
 }
 
 
+// WriteStatus encodes the status of an upload, answering conflicting uploads
+// with 409.
+func WriteStatus(w http.ResponseWriter, result lib.Status) {
+	if len(result.Conflicts) > 0 {
+		w.WriteHeader(http.StatusConflict)
+	} else if result.Quota != nil && result.Quota.Limit == lib.CONFIG_MIN_FREE_SPACE {
+		w.WriteHeader(http.StatusInsufficientStorage)
+	} else if result.Quota != nil {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// WriteRequestError answers a request that could not be processed. Exceeded
+// quotas are reported as a status, other errors as a bad request.
+func WriteRequestError(w http.ResponseWriter, err error) {
+	log.Println(err.Error())
+	if quota, ok := err.(*lib.QuotaError); ok {
+		WriteStatus(w, lib.Status{Health: "Quota exceeded, no files were changed: " + err.Error(), Quota: quota})
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
 func ReverseProxyHandler(p *httputil.ReverseProxy) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		log.Println(r.URL)
@@ -138,8 +329,48 @@ func ReverseProxyHandler(p *httputil.ReverseProxy) func(http.ResponseWriter, *ht
 }
 
 func ListFiles(w http.ResponseWriter, r *http.Request) {
-	files := lib.ListFiles()
-	json.NewEncoder(w).Encode(files)
+	query := r.URL.Query()
+	filter := lib.FileFilter{
+		Prefix: query.Get("prefix"),
+		Glob:   query.Get("glob"),
+		Cursor: query.Get("cursor"),
+	}
+	var err error
+	if raw := query.Get("modified_since"); len(raw) > 0 {
+		if filter.ModifiedSince, err = strconv.ParseInt(raw, 10, 64); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if raw := query.Get("limit"); len(raw) > 0 {
+		if filter.Limit, err = strconv.Atoi(raw); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	files, next, err := lib.FilterFiles(filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(next) > 0 {
+		w.Header().Set(lib.HEADER_NEXT_CURSOR, next)
+	}
+	// stream the entries instead of encoding one large map
+	buffered := bufio.NewWriter(w)
+	buffered.WriteString("{")
+	for i, file := range files {
+		if i > 0 {
+			buffered.WriteString(",")
+		}
+		path, _ := json.Marshal(file.Path)
+		entry, _ := json.Marshal(file.Entry)
+		buffered.Write(path)
+		buffered.WriteString(":")
+		buffered.Write(entry)
+	}
+	buffered.WriteString("}\n")
+	buffered.Flush()
 }
 
 func RestartApp(w http.ResponseWriter, r *http.Request) {
@@ -153,12 +384,256 @@ func GetStatus(w http.ResponseWriter, r *http.Request) {
 }
 
 func UploadFiles(w http.ResponseWriter, r *http.Request) {
-	inputFiles := map[string]*lib.FileEntry{}
-	err := json.NewDecoder(r.Body).Decode(&inputFiles)
+	var result lib.Status
+	dryRun := false
+	if raw := r.URL.Query().Get("dry_run"); len(raw) > 0 {
+		var err error
+		if dryRun, err = strconv.ParseBool(raw); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/x-tar", "application/gzip", "application/x-gzip":
+		var err error
+		result, err = lib.UploadTar(lib.LimitRequest(r.Body), dryRun)
+		if err != nil {
+			WriteRequestError(w, err)
+			return
+		}
+	case "multipart/form-data":
+		r.Body = ioutil.NopCloser(lib.LimitRequest(r.Body))
+		reader, err := r.MultipartReader()
+		if err != nil {
+			log.Println(err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, err = lib.UploadMultipart(reader, dryRun)
+		if err != nil {
+			WriteRequestError(w, err)
+			return
+		}
+	default:
+		inputFiles := map[string]*lib.FileEntry{}
+		err := json.NewDecoder(lib.LimitRequest(r.Body)).Decode(&inputFiles)
+		if err != nil {
+			WriteRequestError(w, err)
+			return
+		}
+		result = lib.UploadFiles(inputFiles, dryRun)
+	}
+	WriteStatus(w, result)
+}
+
+func DeleteFiles(w http.ResponseWriter, r *http.Request) {
+	paths := []string{}
+	err := json.NewDecoder(lib.LimitRequest(r.Body)).Decode(&paths)
+	if err != nil {
+		WriteRequestError(w, err)
+		return
+	}
+	result := lib.DeleteFiles(paths)
+	WriteStatus(w, result)
+}
+
+func GetSignature(w http.ResponseWriter, r *http.Request) {
+	blockSize := 0
+	if raw := r.URL.Query().Get("block_size"); len(raw) > 0 {
+		var err error
+		blockSize, err = strconv.Atoi(raw)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	result, err := lib.GetSignature(r.URL.Query().Get("path"), blockSize)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+func ApplyDeltas(w http.ResponseWriter, r *http.Request) {
+	deltas := map[string]*lib.FileDelta{}
+	err := json.NewDecoder(lib.LimitRequest(r.Body)).Decode(&deltas)
+	if err != nil {
+		WriteRequestError(w, err)
+		return
+	}
+	result := lib.ApplyDeltas(deltas)
+	WriteStatus(w, result)
+}
+
+func StoreBlob(w http.ResponseWriter, r *http.Request, sum string) {
+	err := lib.StoreBlob(sum, lib.LimitRequest(r.Body))
+	if err != nil {
+		WriteRequestError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func HasBlob(w http.ResponseWriter, r *http.Request, sum string) {
+	if !lib.HasBlob(sum) {
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func MissingBlobs(w http.ResponseWriter, r *http.Request) {
+	sums := []string{}
+	err := json.NewDecoder(lib.LimitRequest(r.Body)).Decode(&sums)
+	if err != nil {
+		WriteRequestError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(lib.MissingBlobs(sums))
+}
+
+func CommitManifest(w http.ResponseWriter, r *http.Request) {
+	manifest := map[string]string{}
+	err := json.NewDecoder(lib.LimitRequest(r.Body)).Decode(&manifest)
+	if err != nil {
+		WriteRequestError(w, err)
+		return
+	}
+	result := lib.CommitManifest(manifest)
+	WriteStatus(w, result)
+}
+
+func DownloadFile(w http.ResponseWriter, r *http.Request, path string) {
+	file, info, checksum, err := lib.OpenFile(path)
+	if os.IsNotExist(err) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		log.Println(err.Error())
 		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	result := lib.UploadFiles(inputFiles)
+	defer file.Close()
+	w.Header().Set("ETag", "\"" + checksum + "\"")
+	// ServeContent handles HEAD, Range and conditional requests
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
+
+func DiffFiles(w http.ResponseWriter, r *http.Request) {
+	manifest := map[string]string{}
+	err := json.NewDecoder(lib.LimitRequest(r.Body)).Decode(&manifest)
+	if err != nil {
+		WriteRequestError(w, err)
+		return
+	}
+	result := lib.DiffFiles(manifest)
 	json.NewEncoder(w).Encode(result)
 }
+
+func ListRevisions(w http.ResponseWriter, r *http.Request) {
+	revisions, err := lib.ListRevisions()
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(revisions)
+}
+
+func RollbackRevision(w http.ResponseWriter, r *http.Request, rawID string) {
+	id, err := strconv.Atoi(rawID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	result, err := lib.RollbackRevision(id)
+	if err == lib.ErrUnknownRevision {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	WriteStatus(w, result)
+}
+
+func CreateUpload(w http.ResponseWriter, r *http.Request) {
+	session := lib.UploadSession{}
+	err := json.NewDecoder(lib.LimitRequest(r.Body)).Decode(&session)
+	if err != nil {
+		WriteRequestError(w, err)
+		return
+	}
+	session, err = lib.CreateUploadSession(session)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(session)
+}
+
+func GetUpload(w http.ResponseWriter, r *http.Request, id string) {
+	session, err := lib.GetUploadSession(id)
+	if err == lib.ErrUnknownUpload {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(session)
+}
+
+func AbortUpload(w http.ResponseWriter, r *http.Request, id string) {
+	err := lib.AbortUpload(id)
+	if err == lib.ErrUnknownUpload {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func UploadChunk(w http.ResponseWriter, r *http.Request, id string, rawChunk string) {
+	chunk, err := strconv.Atoi(rawChunk)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	session, err := lib.UploadChunk(id, chunk, lib.LimitRequest(r.Body), r.Header.Get(lib.HEADER_CHECKSUM))
+	if err == lib.ErrUnknownUpload {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		WriteRequestError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(session)
+}
+
+func FinalizeUpload(w http.ResponseWriter, r *http.Request, id string) {
+	result, err := lib.FinalizeUpload(id)
+	if err == lib.ErrUnknownUpload {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	WriteStatus(w, result)
+}
@@ -6,27 +6,53 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"hash"
+	"hash/crc32"
 	"io"
 	"os"
 )
 
+// Supported checksum algorithms
+const (
+	MD5    = "md5"
+	SHA1   = "sha1"
+	SHA256 = "sha256"
+	CRC32C = "crc32c"
+)
+
 // ChecksumInfo represents checksums for a single file
 type ChecksumInfo struct {
 	Size   int64
 	MD5    string
 	SHA1   string
 	SHA256 string
+	CRC32C string
 }
 
-// ChecksumsForFile generates size, MD5, SHA1 & SHA256 checksums for given file
-func ChecksumsForFile(path string) (ChecksumInfo, error) {
+// Get returns the checksum calculated with algorithm
+func (c ChecksumInfo) Get(algorithm string) string {
+	switch algorithm {
+	case MD5:
+		return c.MD5
+	case SHA1:
+		return c.SHA1
+	case SHA256:
+		return c.SHA256
+	case CRC32C:
+		return c.CRC32C
+	}
+	return ""
+}
+
+// ChecksumsForFile generates size and checksums for given file. Without
+// algorithms MD5, SHA1 & SHA256 are calculated
+func ChecksumsForFile(path string, algorithms ...string) (ChecksumInfo, error) {
 	file, err := os.Open(path)
 	if err != nil {
 		return ChecksumInfo{}, err
 	}
 	defer file.Close()
 
-	w := NewChecksumWriter()
+	w := NewChecksumWriter(algorithms...)
 
 	_, err = io.Copy(w, file)
 	if err != nil {
@@ -39,8 +65,9 @@ func ChecksumsForFile(path string) (ChecksumInfo, error) {
 // ChecksumWriter is a writer that does checksum calculation on the fly passing data
 // to real writer
 type ChecksumWriter struct {
-	sum    ChecksumInfo
-	hashes []hash.Hash
+	sum        ChecksumInfo
+	algorithms []string
+	hashes     []hash.Hash
 }
 
 // Interface check
@@ -48,11 +75,43 @@ var (
 	_ io.Writer = &ChecksumWriter{}
 )
 
-// NewChecksumWriter creates checksum calculator for given writer w
-func NewChecksumWriter() *ChecksumWriter {
-	return &ChecksumWriter{
-		hashes: []hash.Hash{md5.New(), sha1.New(), sha256.New()},
+// IsChecksumAlgorithm reports whether algorithm is supported
+func IsChecksumAlgorithm(algorithm string) bool {
+	switch algorithm {
+	case MD5, SHA1, SHA256, CRC32C:
+		return true
 	}
+	return false
+}
+
+func newHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case MD5:
+		return md5.New()
+	case SHA1:
+		return sha1.New()
+	case SHA256:
+		return sha256.New()
+	case CRC32C:
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	}
+	return nil
+}
+
+// NewChecksumWriter creates checksum calculator for given algorithms. Without
+// algorithms MD5, SHA1 & SHA256 are calculated
+func NewChecksumWriter(algorithms ...string) *ChecksumWriter {
+	if len(algorithms) == 0 {
+		algorithms = []string{MD5, SHA1, SHA256}
+	}
+	c := &ChecksumWriter{}
+	for _, algorithm := range algorithms {
+		if h := newHash(algorithm); h != nil {
+			c.algorithms = append(c.algorithms, algorithm)
+			c.hashes = append(c.hashes, h)
+		}
+	}
+	return c
 }
 
 // Write implememnts pass-through writing with checksum calculation on the fly
@@ -68,9 +127,19 @@ func (c *ChecksumWriter) Write(p []byte) (n int, err error) {
 
 // Sum returns caculated ChecksumInfo
 func (c *ChecksumWriter) Sum() ChecksumInfo {
-	c.sum.MD5 = fmt.Sprintf("%x", c.hashes[0].Sum(nil))
-	c.sum.SHA1 = fmt.Sprintf("%x", c.hashes[1].Sum(nil))
-	c.sum.SHA256 = fmt.Sprintf("%x", c.hashes[2].Sum(nil))
+	for i, h := range c.hashes {
+		sum := fmt.Sprintf("%x", h.Sum(nil))
+		switch c.algorithms[i] {
+		case MD5:
+			c.sum.MD5 = sum
+		case SHA1:
+			c.sum.SHA1 = sum
+		case SHA256:
+			c.sum.SHA256 = sum
+		case CRC32C:
+			c.sum.CRC32C = sum
+		}
+	}
 
 	return c.sum
 }
@@ -0,0 +1,38 @@
+package utils
+
+// rollingModulus is the modulus of the rsync weak checksum components
+const rollingModulus = 1 << 16
+
+// RollingChecksum is the rsync weak checksum of a fixed size window. It can be
+// moved over a stream one byte at a time without rehashing the whole window.
+type RollingChecksum struct {
+	a      uint32
+	b      uint32
+	window uint32
+}
+
+// NewRollingChecksum calculates the weak checksum for block
+func NewRollingChecksum(block []byte) *RollingChecksum {
+	r := &RollingChecksum{window: uint32(len(block))}
+	for i, c := range block {
+		r.a = (r.a + uint32(c)) % rollingModulus
+		r.b = (r.b + uint32(len(block)-i)*uint32(c)) % rollingModulus
+	}
+	return r
+}
+
+// Roll moves the window one byte forward, removing out and adding in
+func (r *RollingChecksum) Roll(out byte, in byte) {
+	r.a = (r.a + rollingModulus - uint32(out) + uint32(in)) % rollingModulus
+	r.b = (r.b + rollingModulus - (r.window*uint32(out))%rollingModulus + r.a) % rollingModulus
+}
+
+// Sum returns the combined 32 bit weak checksum
+func (r *RollingChecksum) Sum() uint32 {
+	return r.a | r.b<<16
+}
+
+// WeakChecksum returns the weak checksum of a single block
+func WeakChecksum(block []byte) uint32 {
+	return NewRollingChecksum(block).Sum()
+}